@@ -2,28 +2,27 @@ package main
 
 import (
 	"strings"
-	"regexp"
 	"os"
 	"fmt"
-	"bufio"
 	"slices"
 	"path/filepath"
 	"strconv"
+	"time"
 )
 
 func doBuild(args []string, repo string, gens string, config Config) bool {
-	newGen := genGetLatest(gens) + 1
+	newGen := genGetLatest() + 1
 	comment := ""
 	if len(args) > 1 {
 		comment = strings.Join(args[2:], " ")
 	}
 	newGenDir := genCreate(gens, newGen, comment)
-
-	commentRegex, _ := regexp.Compile("^#")
-	emptyLineRegex, _ := regexp.Compile("^$")
-	hostname, _ := os.Hostname()
+	if newGenDir == "" {
+		return false
+	}
 
 	hasDiff := true
+	var builtHandlers []string
 
 	for _, h := range config.Handlers {
 		if ! handlerShouldRun(h) {
@@ -32,44 +31,35 @@ func doBuild(args []string, repo string, gens string, config Config) bool {
 		logHandler(h.Name, "Calculating new entries")
 
 		// trouver les fichiers a inclure
-		filesRegex, _ := regexp.Compile(fmt.Sprintf("^%s.*$", h.Name))
-		filesRegexHostname, _ := regexp.Compile(fmt.Sprintf("^%s_%s.*$", hostname, h.Name))
-		repoFiles, _ := os.ReadDir(repo)
-
-		var handlerFiles []string
-		for _, f := range repoFiles {
-			if filesRegex.MatchString(f.Name()) || filesRegexHostname.MatchString(f.Name()) {
-				logHandler(h.Name, "+ include file " + f.Name())
-				handlerFiles = append(handlerFiles, f.Name())
-			}
+		handlerFiles := handlerGetRepoFiles(repo, h)
+		for _, f := range handlerFiles {
+			logHandler(h.Name, "+ include file " + f)
 		}
 
 		// generer le resultat
 		if len(handlerFiles) > 0 {
 			var handlerEntries []string
 			for _, f := range handlerFiles {
-				file, _ := os.Open(filepath.Join(repo, f))
-				scanner := bufio.NewScanner(file)
-				for scanner.Scan() {
-					line := scanner.Text()
-					if ! emptyLineRegex.MatchString(line) && ! commentRegex.MatchString(line) {
-						handlerEntries = append(handlerEntries, line)
-					}
-				}
-				file.Close()
+				handlerEntries = append(handlerEntries, handlerReadRepoFile(filepath.Join(repo, f))...)
 			}
 
 			slices.Sort(handlerEntries) // sort
 			handlerEntries = slices.Compact(handlerEntries) // uniq
 
-			handlerResult, _ := os.Create(filepath.Join(newGenDir, h.Name))
+			content := ""
 			for _, p := range handlerEntries {
-				handlerResult.WriteString(p + "\n")
+				content += p + "\n"
 			}
-			handlerResult.Close()
+			err := os.WriteFile(filepath.Join(newGenDir, h.Name), []byte(content), 0644)
+			if err != nil {
+				logError("Could not write entries of handler " + h.Name + ": " + err.Error())
+				genDiscard(newGenDir)
+				return false
+			}
+			builtHandlers = append(builtHandlers, h.Name)
 
 			if ! hasDiff {
-				add, remove := genDiff(gens, genGetLatest(gens), newGen, h)
+				add, remove := genDiff(genGetLatest(), newGen, h)
 				if len(add) > 0 || len(remove) > 0 {
 					hasDiff = true
 				}
@@ -78,31 +68,239 @@ func doBuild(args []string, repo string, gens string, config Config) bool {
 	}
 
 	if hasDiff {
-		genSetLatest(gens, newGen)
+		meta, _ := genReadMeta(newGenDir)
+		meta.Commit = repoGetCommit(repo)
+		meta.Handlers = builtHandlers
+		meta.Hash = genHashDir(newGenDir)
+		if ! genWriteMeta(newGenDir, meta) {
+			genDiscard(newGenDir)
+			return false
+		}
+		if ! genCommit(newGen, newGenDir) || ! genSetLatest(newGen) {
+			return false
+		}
+		historyRecord(gens, "build", -1, newGen, "", genGetComment(newGen))
 		logInfo("Done building generation " + strconv.Itoa(newGen))
 		return true
 	} else {
-		genDelete(gens, newGen)
+		genDiscard(newGenDir)
 		logInfo("No difference with the latest generation, build removed")
 		return false
 	}
 }
 
-func doSwitch(config Config, gens string, targetGen int, dryRun bool) bool {
+func doInfo(num int) bool {
+	fmt.Println("generation: " + strconv.Itoa(num))
+	fmt.Println("comment: " + genGetComment(num))
+	fmt.Println("hash: " + genGetHash(num))
+	meta, ok := genGetMeta(num)
+	if ! ok {
+		logError("Generation " + strconv.Itoa(num) + " has no metadata")
+		return false
+	}
+	if meta.Hash != "" && meta.Hash != genGetHash(num) {
+		fmt.Println(textRed + "stored hash: " + meta.Hash + " (mismatch)" + textReset)
+	}
+	fmt.Println("built: " + meta.Built.Local().Format(time.DateTime))
+	fmt.Println("host: " + meta.Host)
+	fmt.Println("user: " + meta.User)
+	fmt.Println("version: " + meta.Version)
+	if meta.Commit != "" {
+		fmt.Println("commit: " + meta.Commit)
+	}
+	fmt.Println("handlers: " + strings.Join(meta.Handlers, " "))
+	for _, t := range meta.Switched {
+		fmt.Println("switched: " + t.Local().Format(time.DateTime))
+	}
+	return true
+}
+
+// prints the entries added and removed between two generations, returns true if they differ
+func doDiff(config Config, genA int, genB int, handler string) bool {
+	hasDiff := false
+	for _, h := range config.Handlers {
+		if handler != "" && h.Name != handler {
+			continue
+		}
+		if ! handlerShouldRun(h) {
+			continue
+		}
+		logHandler(h.Name, "Showing diff between " + strconv.Itoa(genA) + " and " + strconv.Itoa(genB))
+		if handlerIsKeyValue(h) {
+			add, change, remove := genDiffKeyValue(genA, genB, h)
+			for _, entry := range remove {
+				fmt.Println(textRed + "- " + entry + textReset)
+			}
+			for _, c := range change {
+				fmt.Println(textYellow + "~ " + c.Key + ": " + c.Old + " -> " + c.New + textReset)
+			}
+			for _, entry := range add {
+				fmt.Println(textGreen + "+ " + entry + textReset)
+			}
+			if len(add) > 0 || len(change) > 0 || len(remove) > 0 {
+				hasDiff = true
+			}
+			continue
+		}
+		add, remove := genDiff(genA, genB, h)
+		if len(add) > 0 || len(remove) > 0 {
+			if h.Multiple {
+				fmt.Println(textRed + "- " + strings.Join(remove, " ") + textReset)
+				fmt.Println(textGreen + "+ " + strings.Join(add, " ") + textReset)
+			} else {
+				for _, entry := range remove {
+					fmt.Println(textRed + "- " + entry + textReset)
+				}
+				for _, entry := range add {
+					fmt.Println(textGreen + "+ " + entry + textReset)
+				}
+			}
+			hasDiff = true
+		}
+	}
+	return hasDiff
+}
+
+func doSwitch(config Config, gens string, targetGen int, dryRun bool, rollback bool) bool {
 	logAction("Attempting switch to generation " + strconv.Itoa(targetGen), dryRun)
-	if genSwitch(config, gens, targetGen, genGetCurrent(gens), dryRun) {
+	fromGen := genGetCurrent()
+	if genSwitch(config, gens, targetGen, fromGen, dryRun, false) {
+		if ! dryRun {
+			historyRecordSwitch(config, gens, "switch", fromGen, targetGen)
+		}
 		logAction("Switched to generation " + strconv.Itoa(targetGen), dryRun)
 		return true
 	} else {
 		logError("Switch to generation " + strconv.Itoa(targetGen) + " failed")
+		if rollback && ! dryRun {
+			doUndoSwitch(config, gens)
+		}
+		return false
+	}
+}
+
+func doPlan(config Config, gens string, targetGen int, planFile string) bool {
+	plan, ok := outputPlan(config, gens, genGetCurrent(), targetGen, nil)
+	if ! ok {
+		logError("Could not plan the switch to generation " + strconv.Itoa(targetGen))
+		return false
+	}
+	if planFile == "" {
+		return outputWrite(plan)
+	}
+	// show what has been planned
+	genRunSteps(gens, plan.Steps, nil, true, nil)
+	if ! planWrite(planFile, plan) {
+		return false
+	}
+	logInfo("Plan of the switch to generation " + strconv.Itoa(targetGen) + " written to " + planFile + " (" + strconv.Itoa(len(plan.Steps)) + " steps)")
+	return true
+}
+
+func doSwitchPlan(config Config, gens string, planFile string, dryRun bool, rollback bool) bool {
+	plan, ok := planRead(planFile)
+	if ! ok || ! planCheck(plan) {
+		return false
+	}
+	logAction("Attempting switch to generation " + strconv.Itoa(plan.Target) + " following plan " + planFile, dryRun)
+	journal, ok := genSwitchBegin(gens, plan.From, plan.Target, dryRun, false)
+	if ! ok {
+		return false
+	}
+	if genRunSteps(gens, plan.Steps, journal, dryRun, nil) && genSwitchEnd(plan.Target, journal, dryRun) {
+		if ! dryRun {
+			historyRecordSwitch(config, gens, "switch", plan.From, plan.Target)
+		}
+		logAction("Switched to generation " + strconv.Itoa(plan.Target), dryRun)
+		return true
+	} else {
+		logError("Switch to generation " + strconv.Itoa(plan.Target) + " failed")
+		if rollback && ! dryRun {
+			doUndoSwitch(config, gens)
+		}
+		return false
+	}
+}
+
+func doUndoSwitch(config Config, gens string) bool {
+	currentGen := genGetCurrent()
+	journal := journalLoad(gens)
+	logInfo("Rolling back to generation " + strconv.Itoa(currentGen))
+	if genSwitchUndo(config, gens) {
+		if journal != nil {
+			historyRecord(gens, "undo", journal.From, journal.Target, "", "")
+		}
+		logInfo("Rolled back to generation " + strconv.Itoa(currentGen))
+		return true
+	} else {
+		logError("Rollback to generation " + strconv.Itoa(currentGen) + " is incomplete, consider running `eugene repair`")
+		return false
+	}
+}
+
+func doResume(config Config, gens string, dryRun bool, rollback bool) bool {
+	journal := journalLoad(gens)
+	if journal == nil {
+		logError("There is no interrupted switch to resume")
+		return false
+	}
+	// an interrupted repair goes from the empty generation to the current one
+	repair := journal.From == 0 && journal.Target == genGetCurrent()
+	if journal.From != genGetCurrent() && ! repair {
+		logError("The interrupted switch started from generation " + strconv.Itoa(journal.From) + " which is not the current generation anymore")
+		return false
+	}
+	if ! genExists(journal.Target) {
+		logError("The target generation " + strconv.Itoa(journal.Target) + " of the interrupted switch does not exist anymore")
+		return false
+	}
+	if repair {
+		logAction("Resuming repair of generation " + strconv.Itoa(journal.Target), dryRun)
+	} else {
+		logAction("Resuming switch from generation " + strconv.Itoa(journal.From) + " to generation " + strconv.Itoa(journal.Target), dryRun)
+	}
+	if genSwitch(config, gens, journal.Target, journal.From, dryRun, true) {
+		if repair {
+			if ! dryRun {
+				historyRecord(gens, "repair", -1, journal.Target, "", "")
+			}
+			logAction("Repaired system to generation " + strconv.Itoa(journal.Target), dryRun)
+			return true
+		}
+		if ! dryRun {
+			historyRecordSwitch(config, gens, "switch", journal.From, journal.Target)
+		}
+		logAction("Switched to generation " + strconv.Itoa(journal.Target), dryRun)
+		return true
+	} else {
+		logError("Switch to generation " + strconv.Itoa(journal.Target) + " failed again")
+		// rolling back a repair would remove every entry of the generation
+		if rollback && ! dryRun && ! repair {
+			doUndoSwitch(config, gens)
+		}
+		return false
+	}
+}
+
+func doAbandon(gens string) bool {
+	journal := journalLoad(gens)
+	if journal == nil {
+		logError("There is no interrupted switch to abandon")
 		return false
 	}
+	journalClose(journal)
+	logInfo("Abandoned the switch from generation " + strconv.Itoa(journal.From) + " to generation " + strconv.Itoa(journal.Target))
+	logInfo("The system may be partially switched, consider running `eugene repair`")
+	return true
 }
 
 func doRepair(config Config, gens string, dryRun bool) bool {
-	targetGen := genGetCurrent(gens)
+	targetGen := genGetCurrent()
 	fromGen := 0
-	if genSwitch(config, gens, targetGen, fromGen, dryRun) {
+	if genSwitch(config, gens, targetGen, fromGen, dryRun, false) {
+		if ! dryRun {
+			historyRecord(gens, "repair", -1, targetGen, "", "")
+		}
 		logAction("Repaired system to generation " + strconv.Itoa(targetGen), dryRun)
 		return true
 	} else {
@@ -111,6 +309,120 @@ func doRepair(config Config, gens string, dryRun bool) bool {
 	}
 }
 
+// returns false if any handler drifted from the current generation
+func doStatus(config Config, handler string) bool {
+	currentGen := genGetCurrent()
+	inSync := true
+	for _, h := range config.Handlers {
+		if handler != "" && h.Name != handler {
+			continue
+		}
+		if ! handlerShouldRun(h) {
+			continue
+		}
+		if h.Query == "" {
+			logHandler(h.Name, "Skipped, query command undefined")
+			continue
+		}
+		logHandler(h.Name, "Comparing generation " + strconv.Itoa(currentGen) + " with the system")
+		missing, extras, ok := handlerDrift(currentGen, h)
+		if ! ok {
+			logError("Query command failed for handler " + h.Name)
+			inSync = false
+			continue
+		}
+		for _, entry := range missing {
+			fmt.Println(textRed + "missing: " + entry + textReset)
+		}
+		for _, entry := range extras {
+			fmt.Println(textYellow + "unmanaged: " + entry + textReset)
+		}
+		if len(missing) > 0 || len(extras) > 0 {
+			inSync = false
+		}
+	}
+	if inSync {
+		logInfo("The system matches generation " + strconv.Itoa(currentGen))
+	} else {
+		logInfo("The system differs from generation " + strconv.Itoa(currentGen))
+	}
+	return inSync
+}
+
+// writes the entries present on the system into a repo file
+// entries already in the file are not duplicated, with onlyUndeclared the ones declared in any other file are skipped too
+func doCapture(config Config, repo string, h Handler, fileName string, onlyUndeclared bool, dryRun bool) bool {
+	if h.Query == "" {
+		logError("Handler " + h.Name + " has no query command")
+		return false
+	}
+	if fileName != filepath.Base(fileName) {
+		logError("File " + fileName + " must be directly in the repository")
+		return false
+	}
+	hostname, _ := os.Hostname()
+	if ! strings.HasPrefix(fileName, h.Name) && ! strings.HasPrefix(fileName, hostname + "_" + h.Name) {
+		logHandler(h.Name, "Warning: file " + fileName + " does not match the handler and will not be included in builds")
+	}
+
+	logHandler(h.Name, "Querying entries present on the system")
+	installed, ok := handlerQuery(h)
+	if ! ok {
+		logError("Query command failed for handler " + h.Name)
+		return false
+	}
+
+	filePath := filepath.Join(repo, fileName)
+	known := handlerReadRepoFile(filePath)
+	if onlyUndeclared {
+		for _, f := range handlerGetRepoFiles(repo, h) {
+			known = append(known, handlerReadRepoFile(filepath.Join(repo, f))...)
+		}
+	}
+
+	var captured []string
+	for _, entry := range installed {
+		if ! slices.Contains(known, entry) {
+			captured = append(captured, entry)
+		}
+	}
+	slices.Sort(captured)
+	captured = slices.Compact(captured)
+
+	if len(captured) == 0 {
+		logHandler(h.Name, "Nothing to capture")
+		return true
+	}
+	for _, entry := range captured {
+		fmt.Println(textGreen + "+ " + entry + textReset)
+	}
+	if ! dryRun {
+		f, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			logError("Could not open " + filePath + ": " + err.Error())
+			return false
+		}
+		content := "# captured by eugene on " + time.Now().Format(time.DateTime) + "\n"
+		// the last line of the file may lack its newline
+		if existing, _ := os.ReadFile(filePath); len(existing) > 0 && existing[len(existing) - 1] != '\n' {
+			content = "\n" + content
+		}
+		for _, entry := range captured {
+			content += entry + "\n"
+		}
+		_, err = f.WriteString(content)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			logError("Could not write " + filePath + ": " + err.Error())
+			return false
+		}
+	}
+	logAction("Captured " + strconv.Itoa(len(captured)) + " entries into " + fileName, dryRun)
+	return true
+}
+
 func doUpgrade(config Config, dryRun bool) bool {
 	logInfo("Running upgrade")
 	for _, h := range config.Handlers {
@@ -125,26 +437,21 @@ func doUpgrade(config Config, dryRun bool) bool {
 }
 
 func doAlign(gens string, dryRun bool) {
-	allGens := genGetAll(gens)
-	currentGen := genGetCurrent(gens)
-	latestGen := genGetLatest(gens)
+	allGens := genGetAll()
+	tags := genGetTags()
 	for i, g := range allGens {
 		if g != i {
 			logInfo(strconv.Itoa(g) + " -> " + strconv.Itoa(i))
-			if ! dryRun {
-				genRenumber(gens, g, i)
+			if ! dryRun && genRenumber(g, i) {
+				historyRecord(gens, "align", g, i, "", "")
 			}
-			if g == currentGen {
-				if ! dryRun {
-					genSetCurrent(gens, i)
-				}
-				logInfo("current -> " + strconv.Itoa(i))
-			}
-			if g == latestGen {
-				if ! dryRun {
-					genSetLatest(gens, i)
+			for tag, num := range tags {
+				if num == g {
+					if ! dryRun {
+						genTag(i, tag)
+					}
+					logInfo(tag + " -> " + strconv.Itoa(i))
 				}
-				logInfo("latest -> " + strconv.Itoa(i))
 			}
 		}
 	}
@@ -152,39 +459,46 @@ func doAlign(gens string, dryRun bool) {
 }
 
 func doDeleteDups(gens string, dryRun bool) {
-	allGens := genGetAll(gens)
+	allGens := genGetAll()
 	//var hashesToGens map[string][]int // n'alloue pas la map
 	hashesToGens := make(map[string][]int)
 	for _, g := range allGens {
-		hash := genGetHash(gens, g)
+		hash := genGetHash(g)
 		hashesToGens[hash] = append(hashesToGens[hash], g)
 	}
-	dryCurrent := genGetCurrent(gens)
-	dryLatest := genGetLatest(gens)
+	dryCurrent := genGetCurrent()
+	dryLatest := genGetLatest()
 	for _, gns := range hashesToGens {
 		if len(gns) > 1 {
 			slices.Sort(gns)
 			keepGen := gns[len(gns) - 1]
 			for i := 0; i < len(gns) - 1; i++ {
+				if tags := genGetUserTags(gns[i]); len(tags) > 0 {
+					logInfo("Kept generation " + strconv.Itoa(gns[i]) + " identical to generation " + strconv.Itoa(keepGen) + " because it's pinned by tag " + strings.Join(tags, ", "))
+					continue
+				}
 				currentGen := dryCurrent
 				latestGen := dryLatest
 				if ! dryRun {
-					currentGen = genGetCurrent(gens)
-					latestGen = genGetLatest(gens)
-					genDelete(gens, gns[i])
+					currentGen = genGetCurrent()
+					latestGen = genGetLatest()
 				}
-				logAction("Deleted generation " + strconv.Itoa(gns[i]) + " because it's identical to generation " + strconv.Itoa(keepGen), dryRun)
+				// the current generation can not be deleted, move it first
 				if gns[i] == currentGen {
 					if ! dryRun {
-						genSetCurrent(gens, keepGen)
+						genSetCurrent(keepGen)
 					} else {
 						dryCurrent = keepGen
 					}
 					logInfo("current -> " + strconv.Itoa(keepGen))
 				}
+				if ! dryRun {
+					genDelete(gens, gns[i])
+				}
+				logAction("Deleted generation " + strconv.Itoa(gns[i]) + " because it's identical to generation " + strconv.Itoa(keepGen), dryRun)
 				if gns[i] == latestGen {
 					if ! dryRun {
-						genSetLatest(gens, keepGen)
+						genSetLatest(keepGen)
 					} else {
 						dryLatest = keepGen
 					}
@@ -195,24 +509,154 @@ func doDeleteDups(gens string, dryRun bool) {
 	}
 }
 
-func doRollback(config Config, gens string, n int, dryRun bool) bool {
-	allGens := genGetAll(gens)
-	slices.Sort(allGens)
-	slices.Reverse(allGens)
-    currentGen := genGetCurrent(gens)
-    currentIndex := -1
-    for i, g := range allGens {
-        if g == currentGen {
-            currentIndex = i
-            break
-        }
-    }
-    if currentIndex + n >= len(allGens) {
-        logError("Not enough generations to rollback " + strconv.Itoa(n) + " generations ago")
-        return false
-    }
-    target := allGens[currentIndex + n]
-    logAction("Rolling back to generation " + strconv.Itoa(target), dryRun)
-    genSwitch(config, gens, target, genGetCurrent(gens), dryRun)
-    return true
-}
\ No newline at end of file
+func doTag(gens string, num int, tag string) bool {
+	if genIsBuiltinTag(tag) {
+		logError("Tag " + tag + " is managed by eugene")
+		return false
+	}
+	if ! genIsValidTagName(tag) {
+		logError("Invalid tag name '" + tag + "', it must start with a letter and only contain letters, digits, '.', '_' and '-'")
+		return false
+	}
+	if fileExists(filepath.Join(gens, tag)) && genGetTagged(tag) == -1 {
+		logError("'" + tag + "' can not be used as a tag name")
+		return false
+	}
+	if ! genTag(num, tag) {
+		return false
+	}
+	logInfo("Tagged generation " + strconv.Itoa(num) + " as " + tag)
+	return true
+}
+
+func doUntag(tag string) bool {
+	if genIsBuiltinTag(tag) {
+		logError("Tag " + tag + " is managed by eugene")
+		return false
+	}
+	num := genGetTagged(tag)
+	if num == -1 {
+		logError("Tag " + tag + " does not exist")
+		return false
+	}
+	if ! genUntag(tag) {
+		return false
+	}
+	logInfo("Removed tag " + tag + " from generation " + strconv.Itoa(num))
+	return true
+}
+
+func doTags() {
+	tags := genGetTags()
+	var names []string
+	for tag := range tags {
+		names = append(names, tag)
+	}
+	slices.Sort(names)
+	for _, tag := range names {
+		comment := genGetComment(tags[tag])
+		if comment == "" {
+			comment = "(no comment)"
+		}
+		fmt.Println(tag + " -> " + strconv.Itoa(tags[tag]) + " " + comment)
+	}
+}
+
+// by default, goes back n generations in the switch history, like an undo
+// with byNumber, goes back n generations in number order
+func doRollback(config Config, gens string, n int, byNumber bool, dryRun bool) bool {
+	currentGen := genGetCurrent()
+	target := -1
+	if byNumber {
+		allGens := genGetAll()
+		slices.Sort(allGens)
+		i := slices.Index(allGens, currentGen)
+		if i - n < 0 {
+			logError("Not enough generations to rollback " + strconv.Itoa(n) + " generations ago")
+			return false
+		}
+		target = allGens[i - n]
+	} else {
+		previous := historyPreviousGens(gens)
+		if n > len(previous) {
+			logError("Only " + strconv.Itoa(len(previous)) + " generations were current before generation " + strconv.Itoa(currentGen) + ", can not rollback " + strconv.Itoa(n) + " generations ago")
+			return false
+		}
+		target = previous[len(previous) - n]
+	}
+	// eg. after switching 1 -> 2 -> 1, the generation current two switches ago is the current one
+	if target == currentGen {
+		logError("Generation " + strconv.Itoa(target) + " is already the current generation, rolling back to it makes no sense")
+		return false
+	}
+
+	logAction("Rolling back from generation " + strconv.Itoa(currentGen) + " to generation " + strconv.Itoa(target), dryRun)
+	if dryRun {
+		doDiff(config, currentGen, target, "")
+	}
+	if ! genSwitch(config, gens, target, currentGen, dryRun, false) {
+		return false
+	}
+	if ! dryRun {
+		historyRecordSwitch(config, gens, "rollback", currentGen, target)
+	}
+	return true
+}
+
+// the generations are copied to the new store, then removed from the old one
+// until the current tag is written, the old store remains the one in use
+func doMigrateStore(target GenerationStore) bool {
+	source := store
+	if target.Kind() == source.Kind() {
+		logInfo("The generations directory already uses the " + target.Kind() + " store")
+		return true
+	}
+	if target.Present() {
+		logError("Leftovers of a previous migration are in the way, run `eugene fsck --fix` first")
+		return false
+	}
+
+	allGens := genGetAll()
+	tags := genGetTags()
+	genDirs := make(map[int]string)
+	for _, num := range allGens {
+		genDir := genExtract(num)
+		if genDir == "" {
+			for _, dir := range genDirs {
+				genDiscard(dir)
+			}
+			return false
+		}
+		genDirs[num] = genDir
+	}
+
+	store = target
+	ok := target.Init()
+	for _, num := range allGens {
+		if ok {
+			// latest follows, so that a generation is committed on top of the previous one
+			ok = genCommit(num, genDirs[num]) && genSetLatest(num)
+			genRefreshHash(num)
+			logInfo("Migrated generation " + strconv.Itoa(num))
+		} else {
+			genDiscard(genDirs[num])
+		}
+	}
+	for tag, num := range tags {
+		if ok && tag != "current" && num != -1 {
+			ok = genTag(num, tag)
+		}
+	}
+	if ok {
+		ok = genSetCurrent(tags["current"])
+	}
+	if ! ok {
+		logError("Migration to the " + target.Kind() + " store failed, the " + source.Kind() + " store is still in use, run `eugene fsck --fix` to remove what was migrated")
+		return false
+	}
+
+	// the old store is now a leftover
+	source.Destroy()
+	logInfo("Migrated " + strconv.Itoa(len(allGens)) + " generations to the " + target.Kind() + " store")
+	return true
+}
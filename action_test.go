@@ -0,0 +1,672 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// the subcommands run against a temporary repo and generations directory, with every store
+// the commands of handlers go to a fakeExecutor
+
+type testEnv struct {
+	repo   string
+	gens   string
+	config Config
+	fake   *fakeExecutor
+}
+
+var testPkgs = Handler{Name: "pkgs", Add: "install %s", Remove: "uninstall %s", Multiple: true}
+
+var testSingle = Handler{Name: "single", Add: "add %s", Remove: "del %s"}
+
+func testStoreKinds() []string {
+	return append(slices.Clone(storeKinds), "memory")
+}
+
+// a generations directory holding the empty generation, as main initializes it
+func testSetup(t *testing.T, kind string, handlers ...Handler) *testEnv {
+	t.Helper()
+	env := &testEnv{t.TempDir(), t.TempDir(), Config{Handlers: handlers}, newFakeExecutor()}
+	t.Setenv("EUGENE_REPO", env.repo)
+	t.Setenv("EUGENE_GENS", env.gens)
+
+	previousExecutor, previousStore, previousOutput := executor, store, logOutput
+	t.Cleanup(func() {
+		executor, store, logOutput = previousExecutor, previousStore, previousOutput
+	})
+	executor = env.fake
+	store = storeOpen(env.gens, kind)
+	logOutput = io.Discard
+
+	if ! store.Init() {
+		t.Fatal("could not initialize the store")
+	}
+	emptyGen := genCreate(env.gens, 0, "empty")
+	if emptyGen == "" || ! genCommit(0, emptyGen) || ! genSetLatest(0) || ! genSetCurrent(0) {
+		t.Fatal("could not create generation 0")
+	}
+	return env
+}
+
+// replaces the entries of the repo file, an empty list removes it
+func (env *testEnv) declare(t *testing.T, file string, entries ...string) {
+	t.Helper()
+	path := filepath.Join(env.repo, file)
+	if len(entries) == 0 {
+		os.Remove(path)
+		return
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(entries, "\n") + "\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// builds a generation from the repo files, returns its number
+func (env *testEnv) build(t *testing.T, comment string) int {
+	t.Helper()
+	if ! doBuild([]string{"eugene", "build", comment}, env.repo, env.gens, env.config) {
+		t.Fatal("build failed")
+	}
+	return genGetLatest()
+}
+
+func (env *testEnv) switchTo(t *testing.T, num int) {
+	t.Helper()
+	if ! doSwitch(env.config, env.gens, num, false, false) {
+		t.Fatalf("switch to generation %d failed", num)
+	}
+	env.fake.reset()
+}
+
+func testExpectShells(t *testing.T, fake *fakeExecutor, want []string) {
+	t.Helper()
+	if got := fake.shells(); ! slices.Equal(got, want) {
+		t.Fatalf("commands run:\n  %q\nwant:\n  %q", got, want)
+	}
+}
+
+func TestBuild(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string][]string
+		want  []string
+	}{
+		{"single file", map[string][]string{"pkgs": {"vim", "git"}}, []string{"git", "vim"}},
+		{"files merged and deduplicated", map[string][]string{"pkgs": {"vim", "git"}, "pkgs_dev": {"gcc", "git"}}, []string{"gcc", "git", "vim"}},
+		{"comments ignored", map[string][]string{"pkgs": {"# editor", "vim", ""}}, []string{"vim"}},
+		{"other handlers ignored", map[string][]string{"pkgs": {"vim"}, "flatpaks": {"org.gnome.Maps"}}, []string{"vim"}},
+	}
+	for _, kind := range testStoreKinds() {
+		for _, tt := range tests {
+			t.Run(kind + "/" + tt.name, func(t *testing.T) {
+				env := testSetup(t, kind, testPkgs)
+				for file, entries := range tt.files {
+					env.declare(t, file, entries...)
+				}
+				num := env.build(t, "first")
+				if num != 1 {
+					t.Fatalf("built generation %d, want 1", num)
+				}
+				if got := handlerGetEntries(num, testPkgs); ! slices.Equal(got, tt.want) {
+					t.Fatalf("entries %v, want %v", got, tt.want)
+				}
+				if comment := genGetComment(num); comment != "first" {
+					t.Fatalf("comment %q, want first", comment)
+				}
+				if len(env.fake.commands) != 0 {
+					t.Fatalf("build ran commands: %q", env.fake.shells())
+				}
+			})
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		from     []string
+		to       []string
+		handler  string
+		wantDiff bool
+	}{
+		{"identical", []string{"a", "b"}, []string{"a", "b"}, "", false},
+		{"added", []string{"a"}, []string{"a", "b"}, "", true},
+		{"removed", []string{"a", "b"}, []string{"a"}, "", true},
+		{"other handler only", []string{"a"}, []string{"b"}, "single", false},
+	}
+	for _, kind := range testStoreKinds() {
+		for _, tt := range tests {
+			t.Run(kind + "/" + tt.name, func(t *testing.T) {
+				env := testSetup(t, kind, testPkgs, testSingle)
+				env.declare(t, "pkgs", tt.from...)
+				env.declare(t, "single", "x")
+				from := env.build(t, "from")
+				env.declare(t, "pkgs", tt.to...)
+				to := env.build(t, "to")
+				if got := doDiff(env.config, from, to, tt.handler); got != tt.wantDiff {
+					t.Fatalf("doDiff = %v, want %v", got, tt.wantDiff)
+				}
+			})
+		}
+	}
+}
+
+func TestSwitch(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler Handler
+		from    []string
+		to      []string
+		want    []string
+	}{
+		{"multiple adds at once", testPkgs, nil, []string{"a", "b"}, []string{"install a b"}},
+		{"multiple removes then adds", testPkgs, []string{"a", "b"}, []string{"b", "c"}, []string{"uninstall a", "install c"}},
+		{"one command per entry", testSingle, []string{"a"}, []string{"b", "c"}, []string{"del a", "add b", "add c"}},
+		{"hooks around the entries", Handler{Name: "pkgs", Add: "install %s", Multiple: true, HookPre: "pre", HookPost: "post"}, nil, []string{"a"}, []string{"pre", "install a", "post"}},
+		{"batches", Handler{Name: "pkgs", Add: "install %s", Multiple: true, BatchSize: 2}, nil, []string{"a", "b", "c"}, []string{"install a b", "install c"}},
+	}
+	for _, kind := range testStoreKinds() {
+		for _, tt := range tests {
+			t.Run(kind + "/" + tt.name, func(t *testing.T) {
+				env := testSetup(t, kind, tt.handler)
+				env.declare(t, tt.handler.Name, tt.from...)
+				from := env.build(t, "from")
+				env.declare(t, tt.handler.Name, tt.to...)
+				to := env.build(t, "to")
+				env.switchTo(t, from)
+
+				if ! doSwitch(env.config, env.gens, to, false, false) {
+					t.Fatal("switch failed")
+				}
+				testExpectShells(t, env.fake, tt.want)
+				if current := genGetCurrent(); current != to {
+					t.Fatalf("current generation %d, want %d", current, to)
+				}
+				if journalLoad(env.gens) != nil {
+					t.Fatal("journal left after a successful switch")
+				}
+			})
+		}
+	}
+}
+
+func TestSwitchDryRun(t *testing.T) {
+	env := testSetup(t, "dir", testPkgs)
+	env.declare(t, "pkgs", "a")
+	num := env.build(t, "")
+	if ! doSwitch(env.config, env.gens, num, true, false) {
+		t.Fatal("dry-run switch failed")
+	}
+	testExpectShells(t, env.fake, nil)
+	if current := genGetCurrent(); current != 0 {
+		t.Fatalf("dry-run switch moved current to %d", current)
+	}
+}
+
+func TestSwitchFailureAndResume(t *testing.T) {
+	for _, kind := range testStoreKinds() {
+		t.Run(kind, func(t *testing.T) {
+			env := testSetup(t, kind, testSingle, testPkgs)
+			env.declare(t, "single", "a", "bad", "c")
+			env.declare(t, "pkgs", "p")
+			num := env.build(t, "")
+
+			env.fake.on("^add bad$", 1, "")
+			if doSwitch(env.config, env.gens, num, false, false) {
+				t.Fatal("switch succeeded although a command failed")
+			}
+			testExpectShells(t, env.fake, []string{"add a", "add bad"})
+			if current := genGetCurrent(); current != 0 {
+				t.Fatalf("failed switch moved current to %d", current)
+			}
+			if j := journalLoad(env.gens); j == nil || j.Target != num {
+				t.Fatal("no journal of the failed switch")
+			}
+
+			// the steps already done are not run again
+			env.fake.reset()
+			env.fake.on("^add bad$", 0, "")
+			if ! doResume(env.config, env.gens, false, false) {
+				t.Fatal("resume failed")
+			}
+			testExpectShells(t, env.fake, []string{"add bad", "add c", "install p"})
+			if current := genGetCurrent(); current != num {
+				t.Fatalf("current generation %d after resume, want %d", current, num)
+			}
+		})
+	}
+}
+
+func TestSwitchRollbackOnFailure(t *testing.T) {
+	env := testSetup(t, "dir", testSingle)
+	env.declare(t, "single", "a")
+	from := env.build(t, "")
+	env.switchTo(t, from)
+	env.declare(t, "single", "b", "bad")
+	to := env.build(t, "")
+
+	env.fake.on("^add bad$", 1, "")
+	if doSwitch(env.config, env.gens, to, false, true) {
+		t.Fatal("switch succeeded although a command failed")
+	}
+	testExpectShells(t, env.fake, []string{"del a", "add b", "add bad", "del b", "add a"})
+	if journalLoad(env.gens) != nil {
+		t.Fatal("journal left after the rollback")
+	}
+}
+
+func TestSwitchRequires(t *testing.T) {
+	base := Handler{Name: "base", RunIf: "check base", Add: "base-add %s", Remove: "base-del %s"}
+	dep := Handler{Name: "dep", Add: "dep-add %s", Remove: "dep-del %s", Requires: []string{"base"}}
+	later := Handler{Name: "later", Add: "later-add %s", Remove: "later-del %s", After: []string{"base"}}
+	tests := []struct {
+		name     string
+		baseRuns int
+		want     []string
+	}{
+		// handlers sorted as base, later, dep: removals from the last handler to the first, then the additions in order
+		// the last run_if is the one of the history record
+		{"required handler runs", 0, []string{"check base", "dep-del x", "later-del x", "base-del x", "check base", "base-add y", "later-add y", "dep-add y", "check base"}},
+		{"required handler does not run", 1, []string{"check base", "later-del x", "check base", "later-add y", "check base"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := testSetup(t, "dir", later, dep, base)
+			if ! orderHandlers(&env.config) {
+				t.Fatal("could not order the handlers")
+			}
+			for _, h := range env.config.Handlers {
+				env.declare(t, h.Name, "x")
+			}
+			from := env.build(t, "")
+			for _, h := range env.config.Handlers {
+				env.declare(t, h.Name, "y")
+			}
+			to := env.build(t, "")
+			env.switchTo(t, from)
+
+			env.fake.on("^check base$", tt.baseRuns, "")
+			if ! doSwitch(env.config, env.gens, to, false, false) {
+				t.Fatal("switch failed")
+			}
+			testExpectShells(t, env.fake, tt.want)
+		})
+	}
+}
+
+// the run_if of a handler succeeds once another handler has added its entries
+type testRunIfExecutor struct {
+	*fakeExecutor
+	runIf string
+	after string
+}
+
+func (e testRunIfExecutor) Run(c Command) CommandResult {
+	result := e.fakeExecutor.Run(c)
+	if c.Shell == e.runIf && ! e.ran(e.after) {
+		result.ExitCode = 1
+	}
+	return result
+}
+
+func TestSwitchOrder(t *testing.T) {
+	apt := Handler{Name: "apt", Add: "apt-add %s", Remove: "apt-del %s"}
+	flatpak := Handler{Name: "flatpak", Setup: []RunWhen{{"detect flatpak", "install-flatpak"}}, HookPre: "fp-remote", Sync: "fp-sync", Add: "fp-add %s", Remove: "fp-del %s", After: []string{"apt"}}
+	late := Handler{Name: "late", RunIf: "check late", HookPre: "late-pre", Add: "late-add %s", Remove: "late-del %s"}
+	tests := []struct {
+		name     string
+		handlers []Handler
+		from     map[string][]string
+		to       map[string][]string
+		want     []string
+	}{
+		// only the removals run in reverse order, the hooks and the setup stay with their handler
+		{"hooks with their handler", []Handler{apt, flatpak}, map[string][]string{"apt": {"x"}, "flatpak": {"x"}}, map[string][]string{"apt": {"y"}, "flatpak": {"y"}},
+			[]string{"fp-del x", "apt-del x", "apt-add y", "detect flatpak", "install-flatpak", "fp-remote", "fp-sync", "fp-add y"}},
+		// the run_if of late fails until apt has added its entries, its removals run with its other steps
+		{"run_if succeeding later", []Handler{apt, late}, map[string][]string{"late": {"x"}}, map[string][]string{"apt": {"y"}, "late": {"y"}},
+			[]string{"check late", "apt-add y", "check late", "late-pre", "late-del x", "late-add y", "check late"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := testSetup(t, "dir", tt.handlers...)
+			for _, h := range tt.handlers {
+				env.declare(t, h.Name, tt.from[h.Name]...)
+			}
+			from := env.build(t, "")
+			for _, h := range tt.handlers {
+				env.declare(t, h.Name, tt.to[h.Name]...)
+			}
+			to := env.build(t, "")
+			env.switchTo(t, from)
+			// flatpak is set up again, once apt has run
+			os.Remove(handlerSetupFile(env.gens, "flatpak"))
+			executor = testRunIfExecutor{env.fake, "check late", "^apt-add"}
+
+			if ! doSwitch(env.config, env.gens, to, false, false) {
+				t.Fatal("switch failed")
+			}
+			testExpectShells(t, env.fake, tt.want)
+		})
+	}
+}
+
+func TestSwitchBisect(t *testing.T) {
+	h := Handler{Name: "pkgs", Add: "install %s", Multiple: true, BatchSize: 4, OnBatchFailure: "bisect"}
+	tests := []struct {
+		name        string
+		rules       map[string]int
+		wantOk      bool
+		want        []string
+		wantFailure string
+	}{
+		{"one bad entry", map[string]int{"bad": 1}, false, []string{"install a b bad d", "install a b", "install bad d", "install bad", "install d"}, "add: failing entries bad"},
+		// every half succeeds, the batch is done
+		{"flaky batch", map[string]int{"^install a b bad d$": 1}, true, []string{"install a b bad d", "install a b", "install bad d", "install e"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := testSetup(t, "dir", h)
+			env.declare(t, "pkgs", "a", "b", "bad", "d", "e")
+			num := env.build(t, "")
+			for pattern, exitCode := range tt.rules {
+				env.fake.on(pattern, exitCode, "")
+			}
+			if ok := doSwitch(env.config, env.gens, num, false, false); ok != tt.wantOk {
+				t.Fatalf("switch returned %v, want %v", ok, tt.wantOk)
+			}
+			testExpectShells(t, env.fake, tt.want)
+			failure := ""
+			for _, e := range historyRead(env.gens) {
+				if e.Event == "failure" {
+					failure = e.Detail
+				}
+			}
+			if failure != tt.wantFailure {
+				t.Fatalf("failure recorded %q, want %q", failure, tt.wantFailure)
+			}
+		})
+	}
+}
+
+func TestRepair(t *testing.T) {
+	for _, kind := range testStoreKinds() {
+		t.Run(kind, func(t *testing.T) {
+			h := testPkgs
+			h.Query = "list"
+			env := testSetup(t, kind, h)
+			env.declare(t, "pkgs", "a", "b", "c")
+			num := env.build(t, "")
+			env.switchTo(t, num)
+
+			// only the entries missing from the system are added
+			env.fake.on("^list$", 0, "a\nc\n")
+			if ! doRepair(env.config, env.gens, false) {
+				t.Fatal("repair failed")
+			}
+			if ! env.fake.ran("^install b$") || env.fake.ran("^install .*[ac]") {
+				t.Fatalf("commands run: %q, want only b installed", env.fake.shells())
+			}
+			if current := genGetCurrent(); current != num {
+				t.Fatalf("repair moved current to %d", current)
+			}
+		})
+	}
+}
+
+func TestStatusOutput(t *testing.T) {
+	h := testPkgs
+	h.Query = "list"
+	tests := []struct {
+		name      string
+		installed string
+		inSync    bool
+		status    string
+		missing   []string
+		unmanaged []string
+	}{
+		{"in sync", "a\nb\n", true, "in_sync", nil, nil},
+		{"drifted", "a\nx\n", false, "drifted", []string{"b"}, []string{"x"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := testSetup(t, "dir", h, testSingle)
+			env.declare(t, "pkgs", "a", "b")
+			num := env.build(t, "")
+			env.switchTo(t, num)
+
+			env.fake.on("^list$", 0, tt.installed)
+			doc := outputStatus(env.config, "")
+			if doc.Kind != "status" || doc.Generation != num || doc.InSync != tt.inSync || len(doc.Handlers) != 2 {
+				t.Fatalf("status document %+v", doc)
+			}
+			pkgs, single := doc.Handlers[0], doc.Handlers[1]
+			if pkgs.Status != tt.status || ! slices.Equal(pkgs.Missing, tt.missing) || ! slices.Equal(pkgs.Unmanaged, tt.unmanaged) {
+				t.Fatalf("status of pkgs %+v", pkgs)
+			}
+			if single.Status != "no_query" {
+				t.Fatalf("status of a handler without query %q, want no_query", single.Status)
+			}
+		})
+	}
+}
+
+func TestRollback(t *testing.T) {
+	tests := []struct {
+		name     string
+		n        int
+		byNumber bool
+		want     int
+		shells   []string
+	}{
+		// switched 1 -> 3 -> 2, gens in switch order
+		{"previous switch", 1, false, 3, []string{"uninstall b", "install c"}},
+		{"two switches ago", 2, false, 1, []string{"uninstall b"}},
+		{"by number", 1, true, 1, []string{"uninstall b"}},
+	}
+	for _, kind := range testStoreKinds() {
+		for _, tt := range tests {
+			t.Run(kind + "/" + tt.name, func(t *testing.T) {
+				env := testSetup(t, kind, testPkgs)
+				env.declare(t, "pkgs", "a")
+				first := env.build(t, "")
+				env.declare(t, "pkgs", "a", "b")
+				second := env.build(t, "")
+				env.declare(t, "pkgs", "a", "c")
+				third := env.build(t, "")
+				env.switchTo(t, first)
+				env.switchTo(t, third)
+				env.switchTo(t, second)
+
+				if ! doRollback(env.config, env.gens, tt.n, tt.byNumber, false) {
+					t.Fatal("rollback failed")
+				}
+				if current := genGetCurrent(); current != tt.want {
+					t.Fatalf("current generation %d after rollback, want %d", current, tt.want)
+				}
+				testExpectShells(t, env.fake, tt.shells)
+			})
+		}
+	}
+}
+
+func TestRollbackToCurrent(t *testing.T) {
+	env := testSetup(t, "dir", testPkgs)
+	env.declare(t, "pkgs", "a")
+	first := env.build(t, "")
+	env.declare(t, "pkgs", "b")
+	second := env.build(t, "")
+	env.switchTo(t, first)
+	env.switchTo(t, second)
+	env.switchTo(t, first)
+
+	if doRollback(env.config, env.gens, 2, false, false) {
+		t.Fatal("rollback to the current generation succeeded")
+	}
+	testExpectShells(t, env.fake, nil)
+	for _, e := range historyRead(env.gens) {
+		if e.Event == "rollback" {
+			t.Fatal("rollback recorded in the history")
+		}
+	}
+}
+
+func TestAlign(t *testing.T) {
+	for _, kind := range testStoreKinds() {
+		t.Run(kind, func(t *testing.T) {
+			env := testSetup(t, kind, testPkgs)
+			var nums []int
+			for _, entry := range []string{"a", "b", "c", "d"} {
+				env.declare(t, "pkgs", entry)
+				nums = append(nums, env.build(t, entry))
+			}
+			if ! genDelete(env.gens, nums[0]) || ! genDelete(env.gens, nums[2]) {
+				t.Fatal("delete failed")
+			}
+			if ! doTag(env.gens, nums[3], "stable") {
+				t.Fatal("tag failed")
+			}
+
+			doAlign(env.gens, false)
+			if got := genGetAll(); ! slices.Equal(got, []int{0, 1, 2}) {
+				t.Fatalf("generations %v after align, want [0 1 2]", got)
+			}
+			if comment := genGetComment(2); comment != "d" {
+				t.Fatalf("generation 2 is %q, want d", comment)
+			}
+			if latest := genGetLatest(); latest != 2 {
+				t.Fatalf("latest generation %d, want 2", latest)
+			}
+			if tagged := genGetTagged("stable"); tagged != 2 {
+				t.Fatalf("tag stable on generation %d, want 2", tagged)
+			}
+			testExpectShells(t, env.fake, nil)
+		})
+	}
+}
+
+func TestDeleteDups(t *testing.T) {
+	tests := []struct {
+		name   string
+		tag    bool
+		want   []int
+	}{
+		{"duplicates deleted", false, []int{0, 2, 3}},
+		{"tagged duplicate kept", true, []int{0, 1, 2, 3}},
+	}
+	for _, kind := range testStoreKinds() {
+		for _, tt := range tests {
+			t.Run(kind + "/" + tt.name, func(t *testing.T) {
+				env := testSetup(t, kind, testPkgs)
+				env.declare(t, "pkgs", "a")
+				first := env.build(t, "")
+				env.declare(t, "pkgs", "b")
+				env.build(t, "")
+				env.declare(t, "pkgs", "a")
+				env.build(t, "")
+				env.switchTo(t, first)
+				if tt.tag && ! doTag(env.gens, first, "pinned") {
+					t.Fatal("tag failed")
+				}
+
+				doDeleteDups(env.gens, false)
+				if got := genGetAll(); ! slices.Equal(got, tt.want) {
+					t.Fatalf("generations %v, want %v", got, tt.want)
+				}
+				// current follows the generation it was identical to
+				if current := genGetCurrent(); ! slices.Contains(tt.want, current) || handlerGetEntries(current, testPkgs)[0] != "a" {
+					t.Fatalf("current generation %d", current)
+				}
+				testExpectShells(t, env.fake, nil)
+			})
+		}
+	}
+}
+
+// a line of the output of a handler running in parallel, see parallelFlush
+func testPrefixed(name string, line string) string {
+	return name + " |" + textReset + " " + line
+}
+
+func TestParallelSwitch(t *testing.T) {
+	base := Handler{Name: "base", RunIf: "check base", Add: "base-add %s", LockGroup: "apt"}
+	dep := Handler{Name: "dep", Add: "dep-add %s", Requires: []string{"base"}}
+	other := Handler{Name: "other", RunIf: "check other", Setup: []RunWhen{{"detect other", "setup other"}}, Add: "other-add %s", LockGroup: "apt"}
+	tests := []struct {
+		name     string
+		baseRuns int
+		ran      []string
+		notRan   []string
+		output   []string
+	}{
+		{"required handler runs", 0, []string{"^base-add a$", "^dep-add a$", "^other-add a$"}, nil, []string{testPrefixed("dep", "dep-out")}},
+		{"required handler does not run", 1, []string{"^other-add a$"}, []string{"base-add", "dep-add"}, []string{"dep: " + textReset + textYellow + "skipped"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := testSetup(t, "dir", base, dep, other)
+			env.config.Parallel = true
+			env.config.Jobs = 4
+			for _, h := range env.config.Handlers {
+				env.declare(t, h.Name, "a")
+			}
+			num := env.build(t, "")
+			var output strings.Builder
+			logOutput = &output
+
+			env.fake.on("^check base$", tt.baseRuns, "checking base\n")
+			env.fake.on("^check other$", 0, "checking other\n")
+			env.fake.on("^detect other$", 0, "detecting other\n")
+			env.fake.on("^dep-add", 0, "dep-out\n")
+			if ! doSwitch(env.config, env.gens, num, false, false) {
+				t.Fatal("switch failed")
+			}
+			for _, pattern := range tt.ran {
+				if ! env.fake.ran(pattern) {
+					t.Fatalf("%s was not run, commands run: %q", pattern, env.fake.shells())
+				}
+			}
+			for _, pattern := range tt.notRan {
+				if env.fake.ran(pattern) {
+					t.Fatalf("%s was run", pattern)
+				}
+			}
+			// run_if and setup of the second phase go to the output of their handler
+			for _, want := range append(tt.output, testPrefixed("other", "checking other"), testPrefixed("other", "detecting other"), testPrefixed("other", "$ setup other")) {
+				if ! strings.Contains(output.String(), want) {
+					t.Fatalf("output does not contain %q:\n%s", want, output.String())
+				}
+			}
+			if got := env.fake.shells(); slices.Contains(got, "dep-add a") && slices.Index(got, "dep-add a") < slices.Index(got, "base-add a") {
+				t.Fatal("dep ran before the handler it requires")
+			}
+		})
+	}
+}
+
+func TestParallelRepairQuery(t *testing.T) {
+	h := testPkgs
+	h.Query = "list"
+	env := testSetup(t, "dir", h, testSingle)
+	env.config.Parallel = true
+	env.declare(t, "pkgs", "a")
+	num := env.build(t, "")
+	env.switchTo(t, num)
+
+	if ! doRepair(env.config, env.gens, false) {
+		t.Fatal("repair failed")
+	}
+	// the errors of the query go to the output of the handler, not straight to the terminal
+	for _, c := range env.fake.commands {
+		if c.Shell == "list" && c.Stderr == nil {
+			t.Fatal("the query of a parallel handler writes to the standard error of eugene")
+		}
+	}
+	if ! env.fake.ran("^list$") {
+		t.Fatalf("query not run, commands run: %q", env.fake.shells())
+	}
+}
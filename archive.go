@@ -0,0 +1,276 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// portable archives of generations, made with `eugene export` and read with `eugene import`
+// the archive holds a manifest and one directory per generation, named after its number when exported
+// hashes of the manifest are the ones of the directory store, whatever the store of the exporting eugene
+
+const archiveManifest = "manifest.yml"
+
+type ArchiveGeneration struct {
+	Number  int      `yaml:"number"`
+	Comment string   `yaml:"comment"`
+	Hash    string   `yaml:"hash"`
+	Tags    []string `yaml:"tags"`
+}
+
+type ArchiveManifest struct {
+	SchemaVersion int                 `yaml:"schema_version"`
+	Kind          string              `yaml:"kind"`
+	Generations   []ArchiveGeneration `yaml:"generations"`
+}
+
+func archiveAddFile(tw *tar.Writer, name string, data []byte) bool {
+	err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg})
+	if err == nil {
+		_, err = tw.Write(data)
+	}
+	if err != nil {
+		logError("Could not write " + name + " to the archive: " + err.Error())
+		return false
+	}
+	return true
+}
+
+func archiveAddGeneration(tw *tar.Writer, num int, genPath string) bool {
+	err := filepath.Walk(genPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, _ := filepath.Rel(genPath, path)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if ! archiveAddFile(tw, filepath.ToSlash(filepath.Join(strconv.Itoa(num), rel)), data) {
+			return io.ErrShortWrite
+		}
+		return nil
+	})
+	if err != nil {
+		logError("Could not export generation " + strconv.Itoa(num) + ": " + err.Error())
+		return false
+	}
+	return true
+}
+
+func doExport(nums []int, archivePath string) bool {
+	manifest := ArchiveManifest{outputSchemaVersion, "archive", []ArchiveGeneration{}}
+	genDirs := make(map[int]string)
+	defer func() {
+		for _, dir := range genDirs {
+			genDiscard(dir)
+		}
+	}()
+	for _, num := range nums {
+		genDir := genExtract(num)
+		if genDir == "" {
+			return false
+		}
+		genDirs[num] = genDir
+		manifest.Generations = append(manifest.Generations, ArchiveGeneration{num, genGetComment(num), genHashDir(genDir), genGetUserTags(num)})
+	}
+	data, err := yaml.Marshal(manifest)
+	if err != nil {
+		logError("Could not encode the archive manifest: " + err.Error())
+		return false
+	}
+
+	f, err := os.Create(archivePath)
+	if err != nil {
+		logError("Could not create archive: " + err.Error())
+		return false
+	}
+	defer f.Close()
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+
+	ok := archiveAddFile(tw, archiveManifest, data)
+	for _, num := range nums {
+		ok = ok && archiveAddGeneration(tw, num, genDirs[num])
+	}
+	if ok && (tw.Close() != nil || gw.Close() != nil) {
+		logError("Could not write archive " + archivePath)
+		ok = false
+	}
+	if ! ok {
+		os.Remove(archivePath)
+		return false
+	}
+	logInfo("Exported " + strconv.Itoa(len(nums)) + " generations to " + archivePath)
+	return true
+}
+
+// extracts the archive into a temporary directory of the generations directory
+func archiveExtract(gens string, archivePath string) (string, bool) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		logError("Could not open archive: " + err.Error())
+		return "", false
+	}
+	defer f.Close()
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		logError(archivePath + " is not a gzip archive: " + err.Error())
+		return "", false
+	}
+	tmpDir, err := os.MkdirTemp(gens, tmpPrefix + "import-")
+	if err != nil {
+		logError("Could not create temporary directory: " + err.Error())
+		return "", false
+	}
+
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logError("Could not read archive: " + err.Error())
+			os.RemoveAll(tmpDir)
+			return "", false
+		}
+		name := filepath.Clean(filepath.FromSlash(hdr.Name))
+		if hdr.Typeflag == tar.TypeDir && filepath.IsLocal(name) {
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg || ! filepath.IsLocal(name) {
+			logError("Refusing unexpected entry " + hdr.Name + " of the archive")
+			os.RemoveAll(tmpDir)
+			return "", false
+		}
+		path := filepath.Join(tmpDir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		out, err := os.Create(path)
+		if err == nil {
+			_, err = io.Copy(out, tr)
+			out.Close()
+		}
+		if err != nil {
+			logError("Could not extract " + hdr.Name + ": " + err.Error())
+			os.RemoveAll(tmpDir)
+			return "", false
+		}
+	}
+	return tmpDir, true
+}
+
+func archiveReadManifest(dir string) (ArchiveManifest, bool) {
+	var manifest ArchiveManifest
+	data, err := os.ReadFile(filepath.Join(dir, archiveManifest))
+	if err != nil {
+		logError("The archive has no manifest, it was not made by `eugene export`")
+		return manifest, false
+	}
+	err = yaml.Unmarshal(data, &manifest)
+	if err != nil || manifest.Kind != "archive" {
+		logError("The manifest of the archive is invalid")
+		return manifest, false
+	}
+	if manifest.SchemaVersion != outputSchemaVersion {
+		logError("The archive uses schema version " + strconv.Itoa(manifest.SchemaVersion) + ", this eugene supports version " + strconv.Itoa(outputSchemaVersion))
+		return manifest, false
+	}
+	return manifest, true
+}
+
+// handlers of an archived generation, from its files
+func archiveHandlers(genDir string) []string {
+	var handlers []string
+	files, _ := os.ReadDir(genDir)
+	for _, f := range files {
+		if ! f.IsDir() && ! strings.HasPrefix(f.Name(), "_") {
+			handlers = append(handlers, f.Name())
+		}
+	}
+	return handlers
+}
+
+func doImport(config Config, gens string, archivePath string, retag bool, force bool) bool {
+	tmpDir, ok := archiveExtract(gens, archivePath)
+	if ! ok {
+		return false
+	}
+	defer os.RemoveAll(tmpDir)
+	manifest, ok := archiveReadManifest(tmpDir)
+	if ! ok {
+		return false
+	}
+
+	// everything is checked before anything is imported
+	for _, g := range manifest.Generations {
+		genDir := filepath.Join(tmpDir, strconv.Itoa(g.Number))
+		if ! fileExists(genDir) {
+			logError("Generation " + strconv.Itoa(g.Number) + " is listed in the manifest but missing from the archive")
+			return false
+		}
+		if genHashDir(genDir) != g.Hash {
+			logError("Generation " + strconv.Itoa(g.Number) + " of the archive does not match its hash, the archive is corrupted or was modified")
+			return false
+		}
+		for _, h := range archiveHandlers(genDir) {
+			if _, known := configGetHandler(config, h); ! known {
+				if ! force {
+					logError("Generation " + strconv.Itoa(g.Number) + " of the archive uses handler " + h + " which is not defined in " + configFileName + ", use --force to import it anyway")
+					return false
+				}
+				logInfo("Generation " + strconv.Itoa(g.Number) + " of the archive uses unknown handler " + h)
+			}
+		}
+		for _, tag := range g.Tags {
+			if retag && (genIsBuiltinTag(tag) || ! genIsValidTagName(tag)) {
+				logError("Invalid tag " + tag + " in the archive")
+				return false
+			}
+		}
+	}
+
+	slices.SortFunc(manifest.Generations, func(a ArchiveGeneration, b ArchiveGeneration) int {
+		return a.Number - b.Number
+	})
+	newGen := slices.Max(append(genGetAll(), 0)) + 1
+	for _, g := range manifest.Generations {
+		genDir := filepath.Join(tmpDir, strconv.Itoa(g.Number))
+		// the generation was never switched to on this machine
+		if data, err := os.ReadFile(filepath.Join(genDir, "_meta")); err == nil {
+			if meta, ok := genParseMeta(data); ok && len(meta.Switched) > 0 {
+				meta.Switched = nil
+				if ! genWriteMeta(genDir, meta) {
+					return false
+				}
+			}
+		}
+		if ! genCommit(newGen, genDir) || ! genSetLatest(newGen) {
+			return false
+		}
+		genRefreshHash(newGen)
+		historyRecord(gens, "import", g.Number, newGen, "", archivePath)
+		logInfo("Imported generation " + strconv.Itoa(g.Number) + " of the archive as generation " + strconv.Itoa(newGen))
+		if retag {
+			for _, tag := range g.Tags {
+				if previous := genGetTagged(tag); previous != -1 && previous != newGen {
+					logInfo("Tag " + tag + " moved from generation " + strconv.Itoa(previous))
+				}
+				if ! genTag(newGen, tag) {
+					return false
+				}
+				logInfo("Tagged generation " + strconv.Itoa(newGen) + " as " + tag)
+			}
+		}
+		newGen++
+	}
+	return true
+}
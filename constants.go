@@ -1,5 +1,7 @@
 package main
 
+const version = "v4"
+
 const configFileName = "eugene.yml"
 
 const defaultConf = `# eugene sample configuration file
@@ -13,10 +15,14 @@ handlers:
     # if multiple, add and remove commands are executed once for every entry (eg. apt install vim jq curl)
     # else, one command is executed for each entry (eg. apt install vim, apt install jq, apt install curl)
     multiple: true
+    # optional, lists the entries actually installed on the system (one per line)
+    # used by eugene status and eugene repair
+    query: apt-mark showmanual
     # run anything before and after switching
     # supports your shell's environment variables and eugene's environment variables
     run_before_switch: echo "$(dpkg -l | wc -l) packages on system"
     # commands are litteraly run as sh -c "$cmd", you can therefore use && ; || $()...
+    # with parallel: true, commands get no standard input, use non-interactive ones (eg. apt-get -y, sudo -n)
     run_after_switch: echo "now $(dpkg -l | wc -l) packages on system"
   - name: flatpak
     setup:
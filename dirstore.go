@@ -0,0 +1,259 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the default store: generation n is the directory n of the generations directory
+// tags are symlinks of the generations directory pointing to a generation directory
+
+type dirStore struct {
+	gens string
+}
+
+func (s *dirStore) path(num int) string {
+	return filepath.Join(s.gens, strconv.Itoa(num))
+}
+
+func (s *dirStore) Kind() string {
+	return "dir"
+}
+
+func (s *dirStore) Init() bool {
+	return true
+}
+
+func (s *dirStore) Present() bool {
+	return len(storeDirFiles(s.gens)) > 0
+}
+
+func (s *dirStore) Destroy() bool {
+	ok := true
+	for _, name := range storeDirFiles(s.gens) {
+		ok = os.RemoveAll(filepath.Join(s.gens, name)) == nil && ok
+	}
+	return ok
+}
+
+func (s *dirStore) Commit(num int, tmpDir string) bool {
+	err := os.Chmod(tmpDir, 0755)
+	if err == nil {
+		err = os.Rename(tmpDir, s.path(num))
+	}
+	if err != nil {
+		logError("Could not create generation " + strconv.Itoa(num) + ": " + err.Error())
+		genDiscard(tmpDir)
+		return false
+	}
+	return true
+}
+
+func (s *dirStore) List() []int {
+	generationRegex, _ := regexp.Compile("^[0-9]+$")
+	var resultArr []int
+
+	allGens, _ := os.ReadDir(s.gens)
+	for _, g := range allGens {
+		if generationRegex.MatchString(g.Name()) {
+			num, _ := strconv.Atoi(g.Name())
+			resultArr = append(resultArr, num)
+		}
+	}
+
+	slices.Sort(resultArr)
+	return resultArr
+}
+
+func (s *dirStore) Exists(num int) bool {
+	return fileExists(s.path(num))
+}
+
+func (s *dirStore) Hash(num int) string {
+	return genHashDir(s.path(num))
+}
+
+func (s *dirStore) Delete(num int) bool {
+	// moved out of the way first, so that a crash never leaves a partially deleted generation
+	trash := filepath.Join(s.gens, tmpPrefix + "deleted-" + strconv.Itoa(num))
+	err := os.Rename(s.path(num), trash)
+	if err != nil {
+		logError("Could not delete generation " + strconv.Itoa(num) + ": " + err.Error())
+		return false
+	}
+	os.RemoveAll(trash)
+	return true
+}
+
+func (s *dirStore) Renumber(old int, new int) bool {
+	err := os.Rename(s.path(old), s.path(new))
+	if err != nil {
+		logError("Could not renumber generation " + strconv.Itoa(old) + " to " + strconv.Itoa(new) + ": " + err.Error())
+		return false
+	}
+	return true
+}
+
+func (s *dirStore) Extract(num int) string {
+	tmpDir, err := storeTempDir(s.gens, strconv.Itoa(num))
+	if err != nil {
+		logError("Could not extract generation " + strconv.Itoa(num) + ": " + err.Error())
+		return ""
+	}
+	for _, f := range s.ListFiles(num) {
+		data, _ := s.ReadFile(num, f)
+		if storeWriteTempFile(tmpDir, f, data) != nil {
+			logError("Could not extract " + f + " of generation " + strconv.Itoa(num))
+			genDiscard(tmpDir)
+			return ""
+		}
+	}
+	return tmpDir
+}
+
+func (s *dirStore) ReadFile(num int, name string) ([]byte, bool) {
+	data, err := os.ReadFile(filepath.Join(s.path(num), filepath.FromSlash(name)))
+	return data, err == nil
+}
+
+func (s *dirStore) WriteFile(num int, name string, data []byte) bool {
+	path := filepath.Join(s.path(num), filepath.FromSlash(name))
+	os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	err := os.WriteFile(path, data, 0644)
+	if err != nil {
+		logError("Could not write " + name + " of generation " + strconv.Itoa(num) + ": " + err.Error())
+		return false
+	}
+	return true
+}
+
+// like a git tree, a directory does not outlive its last file
+func (s *dirStore) RemoveFile(num int, name string) bool {
+	genPath := s.path(num)
+	path := filepath.Join(genPath, filepath.FromSlash(name))
+	err := os.Remove(path)
+	if err != nil {
+		logError("Could not remove " + name + " of generation " + strconv.Itoa(num) + ": " + err.Error())
+		return false
+	}
+	for dir := filepath.Dir(path); dir != genPath; dir = filepath.Dir(dir) {
+		content, _ := os.ReadDir(dir)
+		if len(content) > 0 {
+			break
+		}
+		os.Remove(dir)
+	}
+	return true
+}
+
+func (s *dirStore) ListFiles(num int) []string {
+	var files []string
+	if ! s.Exists(num) {
+		return files
+	}
+	genPath := s.path(num)
+	filepath.Walk(genPath, func(path string, info os.FileInfo, err error) error {
+		if err == nil && ! info.IsDir() {
+			rel, _ := filepath.Rel(genPath, path)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return files
+}
+
+func (s *dirStore) Tag(num int, tag string) bool {
+	tmpLink := filepath.Join(s.gens, tmpPrefix + "tag-" + tag)
+	os.Remove(tmpLink)
+	err := os.Symlink(strconv.Itoa(num), tmpLink)
+	if err == nil {
+		err = os.Rename(tmpLink, filepath.Join(s.gens, tag))
+	}
+	if err != nil {
+		os.Remove(tmpLink)
+		logError("Could not tag generation " + strconv.Itoa(num) + " as " + tag + ": " + err.Error())
+		return false
+	}
+	return true
+}
+
+func (s *dirStore) Tagged(tag string) int {
+	g, err := os.Readlink(filepath.Join(s.gens, tag))
+	if err != nil {
+		return -1
+	}
+	num, err := strconv.Atoi(g)
+	if err != nil {
+		return -1
+	}
+	return num
+}
+
+func (s *dirStore) Untag(tag string) bool {
+	err := os.Remove(filepath.Join(s.gens, tag))
+	if err != nil {
+		logError("Could not remove tag " + tag + ": " + err.Error())
+		return false
+	}
+	return true
+}
+
+// the symlinks of the generations directory, current and latest included
+func (s *dirStore) Tags() map[string]int {
+	tags := make(map[string]int)
+	entries, _ := os.ReadDir(s.gens)
+	for _, e := range entries {
+		if e.Type() & os.ModeSymlink == 0 || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		tags[e.Name()] = s.Tagged(e.Name())
+	}
+	return tags
+}
+
+// generations without metadata are dated by their directory
+func (s *dirStore) modTime(num int) time.Time {
+	info, err := os.Stat(s.path(num))
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// a git store left by an interrupted migration to it
+func (s *dirStore) check(fix bool) int {
+	gs := &gitStore{s.gens}
+	if ! gs.Present() {
+		return 0
+	}
+	msg := "Incomplete git store " + gitStoreName + " left by an interrupted migration"
+	fixed := fix && gs.Destroy()
+	fsckReport(msg, fixed)
+	if ! fixed {
+		return 1
+	}
+	return 0
+}
+
+// storage namespaces left empty, a git tree can not hold them
+func (s *dirStore) emptyNamespaces(num int) []string {
+	var empty []string
+	storagePath := filepath.Join(s.path(num), "storage")
+	namespaces, _ := os.ReadDir(storagePath)
+	for _, ns := range namespaces {
+		keys, _ := os.ReadDir(filepath.Join(storagePath, ns.Name()))
+		if ns.IsDir() && len(keys) == 0 {
+			empty = append(empty, ns.Name())
+		}
+	}
+	return empty
+}
+
+func (s *dirStore) removeNamespace(num int, namespace string) bool {
+	return os.Remove(filepath.Join(s.path(num), "storage", namespace)) == nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// how the commands of handlers are run: add, remove, sync, hooks, setup, run_if, query and upgrade
+// the default executor runs them with `sh -c`, the fakeExecutor of the tests only records them
+
+type Command struct {
+	Shell string
+	// added to the environment of eugene
+	Env   []string
+	Stdin io.Reader
+	// the standard output is returned instead of going to Stdout
+	Capture bool
+	// the log output and the standard error of eugene when nil
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+type CommandResult struct {
+	ExitCode int
+	Stdout   []byte
+}
+
+type Executor interface {
+	// the exit code is -1 when the command could not be started
+	Run(c Command) CommandResult
+}
+
+var executor Executor = &shellExecutor{}
+
+func commandStdout(c Command) io.Writer {
+	if c.Stdout == nil {
+		return logOutput
+	}
+	return c.Stdout
+}
+
+type shellExecutor struct{}
+
+func (e *shellExecutor) Run(c Command) CommandResult {
+	cmd := exec.Command("sh", "-c", c.Shell)
+	cmd.Env = append(os.Environ(), c.Env...)
+	cmd.Stdin = c.Stdin
+	cmd.Stdout = commandStdout(c)
+	cmd.Stderr = c.Stderr
+	if c.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
+	var stdout bytes.Buffer
+	if c.Capture {
+		cmd.Stdout = &stdout
+	}
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return CommandResult{exitErr.ExitCode(), stdout.Bytes()}
+	}
+	if err != nil {
+		logError("Could not run " + c.Shell + ": " + err.Error())
+		return CommandResult{-1, nil}
+	}
+	return CommandResult{0, stdout.Bytes()}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"regexp"
+	"slices"
+	"sync"
+)
+
+// records the commands instead of running them, their results are scripted with on
+// commands matching no rule succeed without output
+// handlers running in parallel use it concurrently
+type fakeExecutor struct {
+	mu       sync.Mutex
+	commands []Command
+	rules    []fakeRule
+}
+
+type fakeRule struct {
+	pattern *regexp.Regexp
+	result  CommandResult
+}
+
+func newFakeExecutor() *fakeExecutor {
+	return &fakeExecutor{}
+}
+
+// the result of the commands matching the pattern, the last matching rule wins
+func (e *fakeExecutor) on(pattern string, exitCode int, stdout string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.rules = append(e.rules, fakeRule{regexp.MustCompile(pattern), CommandResult{exitCode, []byte(stdout)}})
+}
+
+func (e *fakeExecutor) Run(c Command) CommandResult {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.commands = append(e.commands, c)
+	result := CommandResult{0, nil}
+	for _, r := range e.rules {
+		if r.pattern.MatchString(c.Shell) {
+			result = r.result
+		}
+	}
+	if ! c.Capture && len(result.Stdout) > 0 {
+		commandStdout(c).Write(result.Stdout)
+	}
+	return result
+}
+
+// the shell commands run so far, in order
+func (e *fakeExecutor) shells() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var shells []string
+	for _, c := range e.commands {
+		shells = append(shells, c.Shell)
+	}
+	return shells
+}
+
+func (e *fakeExecutor) ran(pattern string) bool {
+	re := regexp.MustCompile(pattern)
+	return slices.ContainsFunc(e.shells(), re.MatchString)
+}
+
+func (e *fakeExecutor) reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.commands = nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// checks the consistency of the generations directory
+// with fix, every problem that can be repaired is repaired
+// returns false if problems remain
+
+func fsckReport(msg string, fixed bool) {
+	if fixed {
+		logInfo(msg + textGreen + " (fixed)")
+	} else {
+		logError(msg)
+	}
+}
+
+func fsckCheckTag(tag string, fallback int, fix bool) bool {
+	num := genGetTagged(tag)
+	if num != -1 && genExists(num) {
+		return true
+	}
+	msg := "Tag " + tag + " is missing or points to a generation that does not exist"
+	if fix && genTag(fallback, tag) {
+		fsckReport(msg + ", now pointing to generation " + strconv.Itoa(fallback), true)
+		return true
+	}
+	fsckReport(msg, false)
+	return false
+}
+
+// the most recently switched to generation, 0 if none was ever switched to
+func fsckGuessCurrent() int {
+	guess := 0
+	var guessTime time.Time
+	for _, num := range genGetAll() {
+		meta, ok := genGetMeta(num)
+		if ! ok {
+			continue
+		}
+		if last, ok := genLastSwitched(meta); ok && last.After(guessTime) {
+			guess = num
+			guessTime = last
+		}
+	}
+	return guess
+}
+
+func fsckCheckGeneration(num int, fix bool) bool {
+	ok := true
+	meta, hasMeta := genGetMeta(num)
+	if ! hasMeta {
+		msg := "Generation " + strconv.Itoa(num) + " has no metadata"
+		fixed := false
+		if fix {
+			meta = GenMeta{Built: genGetBuilt(num).Truncate(time.Second), Version: version, Hash: genGetHash(num)}
+			for _, f := range genListFiles(num) {
+				if ! strings.Contains(f, "/") && ! strings.HasPrefix(f, "_") {
+					meta.Handlers = append(meta.Handlers, f)
+				}
+			}
+			fixed = genSetMeta(num, meta)
+		}
+		fsckReport(msg, fixed)
+		ok = fixed
+	}
+
+	for _, h := range meta.Handlers {
+		if _, found := genReadFile(num, h); ! found {
+			fsckReport("Generation " + strconv.Itoa(num) + " is missing the entries of handler " + h, false)
+			ok = false
+		}
+	}
+
+	if meta.Hash != "" && meta.Hash != genGetHash(num) {
+		fsckReport("Generation " + strconv.Itoa(num) + " does not match its stored hash, its content was modified", false)
+		ok = false
+	}
+
+	// only directories can be left empty
+	ns, hasNamespaces := store.(namespaceStore)
+	if ! hasNamespaces {
+		return ok
+	}
+	for _, namespace := range ns.emptyNamespaces(num) {
+		msg := "Storage namespace " + namespace + " of generation " + strconv.Itoa(num) + " is empty"
+		fixed := fix && ns.removeNamespace(num, namespace)
+		fsckReport(msg, fixed)
+		ok = ok && fixed
+	}
+	return ok
+}
+
+func doFsck(config Config, gens string, fix bool) bool {
+	problems := 0
+	allGens := genGetAll()
+
+	if cs, ok := store.(checkedStore); ok {
+		problems += cs.check(fix)
+	}
+
+	if ! slices.Contains(allGens, 0) {
+		msg := "Generation 0 is missing"
+		fixed := false
+		if fix {
+			emptyGen := genCreate(gens, 0, "Empty generation (automatically created)")
+			fixed = emptyGen != "" && genCommit(0, emptyGen)
+			allGens = genGetAll()
+		}
+		fsckReport(msg, fixed)
+		if ! fixed {
+			problems++
+		}
+	}
+
+	for _, num := range allGens {
+		if ! fsckCheckGeneration(num, fix) {
+			problems++
+		}
+	}
+
+	if ! fsckCheckTag("latest", slices.Max(append(allGens, 0)), fix) {
+		problems++
+	}
+	if ! fsckCheckTag("current", fsckGuessCurrent(), fix) {
+		problems++
+	}
+
+	for tag, num := range genGetTags() {
+		if genIsBuiltinTag(tag) || (num != -1 && genExists(num)) {
+			continue
+		}
+		msg := "Tag " + tag + " points to a generation that does not exist"
+		fixed := fix && genUntag(tag)
+		fsckReport(msg, fixed)
+		if ! fixed {
+			problems++
+		}
+	}
+
+	if journal := journalLoad(gens); journal != nil {
+		if ! genExists(journal.Target) || ! genExists(journal.From) {
+			msg := "The journal of the interrupted switch refers to a generation that does not exist"
+			fixed := false
+			if fix {
+				journalClose(journal)
+				fixed = true
+			}
+			fsckReport(msg, fixed)
+			if ! fixed {
+				problems++
+			}
+		} else {
+			logInfo("A switch from generation " + strconv.Itoa(journal.From) + " to generation " + strconv.Itoa(journal.Target) + " did not complete, run `eugene switch --resume`")
+		}
+	}
+
+	entries, _ := os.ReadDir(gens)
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, ".setup-") {
+			if _, ok := configGetHandler(config, strings.TrimPrefix(name, ".setup-")); ! ok {
+				msg := "Setup marker " + name + " belongs to a handler that is not configured anymore"
+				fixed := fix && os.Remove(filepath.Join(gens, name)) == nil
+				fsckReport(msg, fixed)
+				if ! fixed {
+					problems++
+				}
+			}
+		}
+		if strings.HasPrefix(name, tmpPrefix) {
+			// with fix, the lock was taken and leftovers were already cleaned up
+			fsckReport("Leftover " + name + " of an interrupted operation", false)
+			problems++
+		}
+	}
+
+	if problems > 0 {
+		logError(strconv.Itoa(problems) + " problems remaining in " + gens)
+		return false
+	}
+	logInfo("No problem found in " + gens)
+	return true
+}
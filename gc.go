@@ -0,0 +1,150 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// retention policy of `eugene gc`, like restic's forget
+// a generation is kept if any rule keeps it, generation 0, current, latest and tagged generations are always kept
+type GcPolicy struct {
+	KeepLast   int    `yaml:"keep_last"`
+	OlderThan  string `yaml:"older_than"`
+	KeepDaily  int    `yaml:"keep_daily"`
+	KeepWeekly int    `yaml:"keep_weekly"`
+}
+
+func gcPolicyIsEmpty(p GcPolicy) bool {
+	return p.KeepLast == 0 && p.OlderThan == "" && p.KeepDaily == 0 && p.KeepWeekly == 0
+}
+
+// accepts days and weeks on top of go durations, eg. 30d, 2w, 12h
+func gcParseAge(age string) (time.Duration, bool) {
+	if strings.HasSuffix(age, "d") || strings.HasSuffix(age, "w") {
+		n, err := strconv.Atoi(age[:len(age) - 1])
+		if err != nil || n < 0 {
+			return 0, false
+		}
+		day := 24 * time.Hour
+		if strings.HasSuffix(age, "w") {
+			return time.Duration(n) * 7 * day, true
+		}
+		return time.Duration(n) * day, true
+	}
+	d, err := time.ParseDuration(age)
+	return d, err == nil && d >= 0
+}
+
+// keeps the most recent generation of each of the n most recent periods
+func gcKeepPeriods(gens []int, built map[int]time.Time, n int, period func(time.Time) string, keep map[int]string, reason string) {
+	seen := 0
+	lastPeriod := ""
+	for _, g := range gens {
+		if seen >= n {
+			return
+		}
+		p := period(built[g])
+		if p != lastPeriod {
+			if _, ok := keep[g]; ! ok {
+				keep[g] = reason
+			}
+			lastPeriod = p
+			seen++
+		}
+	}
+}
+
+// returns the generations to delete, most recent first
+func gcSelect(gens string, policy GcPolicy) ([]int, bool) {
+	var maxAge time.Duration
+	if policy.OlderThan != "" {
+		age, ok := gcParseAge(policy.OlderThan)
+		if ! ok {
+			logError("Invalid age '" + policy.OlderThan + "', expected eg. 30d, 2w or 12h")
+			return nil, false
+		}
+		maxAge = age
+	}
+
+	allGens := genGetAll()
+	built := make(map[int]time.Time)
+	for _, g := range allGens {
+		built[g] = genGetBuilt(g)
+	}
+	// most recent first
+	slices.SortFunc(allGens, func(a int, b int) int {
+		if c := built[b].Compare(built[a]); c != 0 {
+			return c
+		}
+		return b - a
+	})
+
+	keep := make(map[int]string)
+	keep[0] = "generation 0"
+	keep[genGetCurrent()] = "current"
+	keep[genGetLatest()] = "latest"
+	for _, g := range allGens {
+		if tags := genGetUserTags(g); len(tags) > 0 {
+			keep[g] = "tagged " + strings.Join(tags, ", ")
+		}
+	}
+	if journal := journalLoad(gens); journal != nil {
+		keep[journal.From] = "interrupted switch"
+		keep[journal.Target] = "interrupted switch"
+	}
+
+	for i := 0; i < policy.KeepLast && i < len(allGens); i++ {
+		if _, ok := keep[allGens[i]]; ! ok {
+			keep[allGens[i]] = "keep-last"
+		}
+	}
+	gcKeepPeriods(allGens, built, policy.KeepDaily, func(t time.Time) string {
+		return t.Local().Format(time.DateOnly)
+	}, keep, "keep-daily")
+	gcKeepPeriods(allGens, built, policy.KeepWeekly, func(t time.Time) string {
+		year, week := t.Local().ISOWeek()
+		return strconv.Itoa(year) + "-" + strconv.Itoa(week)
+	}, keep, "keep-weekly")
+
+	var reclaim []int
+	for _, g := range allGens {
+		if _, ok := keep[g]; ok {
+			continue
+		}
+		if policy.OlderThan != "" && time.Since(built[g]) < maxAge {
+			continue
+		}
+		reclaim = append(reclaim, g)
+	}
+	return reclaim, true
+}
+
+func doGc(gens string, policy GcPolicy, dryRun bool) bool {
+	if gcPolicyIsEmpty(policy) {
+		logError("No retention policy, set one in the gc section of " + configFileName + " or with --keep-last, --older-than, --keep-daily or --keep-weekly")
+		return false
+	}
+	reclaim, ok := gcSelect(gens, policy)
+	if ! ok {
+		return false
+	}
+	if len(reclaim) == 0 {
+		logInfo("Nothing to reclaim")
+		return true
+	}
+
+	var reclaimed []string
+	success := true
+	for _, g := range reclaim {
+		if ! dryRun && ! genDelete(gens, g) {
+			success = false
+			continue
+		}
+		reclaimed = append(reclaimed, strconv.Itoa(g))
+	}
+	slices.Reverse(reclaimed)
+	logAction("Reclaimed " + strconv.Itoa(len(reclaimed)) + " generations: " + strings.Join(reclaimed, ", "), dryRun)
+	return success
+}
@@ -9,59 +9,232 @@ import (
     "regexp"
     "crypto/sha256"
     "fmt"
+    "strings"
+    "time"
+    "os/user"
+    "io"
+
+    "gopkg.in/yaml.v2"
 )
 
+// stored in the _meta file of each generation
+// like _comment, it is not part of the generation's hash
+type GenMeta struct {
+    Built time.Time `yaml:"built" json:"built"`
+    Host string `yaml:"host" json:"host"`
+    User string `yaml:"user" json:"user"`
+    Version string `yaml:"version" json:"version"`
+    Commit string `yaml:"commit,omitempty" json:"commit,omitempty"`
+    Hash string `yaml:"hash" json:"hash"`
+    Handlers []string `yaml:"handlers" json:"handlers"`
+    Switched []time.Time `yaml:"switched,omitempty" json:"switched,omitempty"`
+}
+
+// generations are built in a temporary directory, renamed into place by genCommit
+// temporary files are prefixed with .tmp- and cleaned up by genCleanup
+const tmpPrefix = ".tmp-"
+
 func genCreate(gens string, num int, comment string) string {
-    thisGenDir := filepath.Join(gens, strconv.Itoa(num))
-    os.Mkdir(thisGenDir, os.ModePerm)
+    tmpDir, err := storeTempDir(gens, strconv.Itoa(num))
+    if err != nil {
+        logError("Could not create generation " + strconv.Itoa(num) + ": " + err.Error())
+        return ""
+    }
     if comment != "" {
-        commentFile, _ := os.Create(filepath.Join(thisGenDir, "_comment"))
-        commentFile.WriteString(comment + "\n")
-        commentFile.Close()
+        err = os.WriteFile(filepath.Join(tmpDir, "_comment"), []byte(comment + "\n"), 0644)
+        if err != nil {
+            logError("Could not write comment of generation " + strconv.Itoa(num) + ": " + err.Error())
+            genDiscard(tmpDir)
+            return ""
+        }
+    }
+    hostname, _ := os.Hostname()
+    username := ""
+    if u, err := user.Current(); err == nil {
+        username = u.Username
+    }
+    meta := GenMeta{
+        Built: time.Now().Truncate(time.Second),
+        Host: hostname,
+        User: username,
+        Version: version,
+        Hash: genHashDir(tmpDir),
+    }
+    if ! genWriteMeta(tmpDir, meta) {
+        genDiscard(tmpDir)
+        return ""
     }
-    return thisGenDir
+    return tmpDir
 }
 
-func genTag(gens string, num int, tag string) {
-    currentDir, _ := os.Getwd()
-    os.Chdir(gens)
-    os.Remove(tag)
-    os.Symlink(strconv.Itoa(num), tag)
-    os.Chdir(currentDir)
+func genCommit(num int, tmpDir string) bool {
+    return store.Commit(num, tmpDir)
 }
 
-func genGetTagged(gens string, tag string) int {
-    g, _ := os.Readlink(filepath.Join(gens, tag))
-    num, _ := strconv.Atoi(g)
-    return num
+func genDiscard(tmpDir string) {
+    os.RemoveAll(tmpDir)
+}
+
+// removes what interrupted operations left behind
+// only call it while holding the lock, temporary files of a running operation would be removed otherwise
+func genCleanup(gens string) {
+    entries, _ := os.ReadDir(gens)
+    for _, e := range entries {
+        if strings.HasPrefix(e.Name(), tmpPrefix) {
+            err := os.RemoveAll(filepath.Join(gens, e.Name()))
+            if err != nil {
+                logError("Could not remove leftover " + e.Name() + ": " + err.Error())
+            } else {
+                logInfo("Removed leftover " + e.Name() + " of an interrupted operation")
+            }
+        }
+    }
+}
+
+func genReadMeta(dir string) (GenMeta, bool) {
+    data, err := os.ReadFile(filepath.Join(dir, "_meta"))
+    if err != nil {
+        return GenMeta{}, false
+    }
+    return genParseMeta(data)
+}
+
+func genParseMeta(data []byte) (GenMeta, bool) {
+    var meta GenMeta
+    if yaml.Unmarshal(data, &meta) != nil {
+        return meta, false
+    }
+    return meta, true
+}
+
+func genWriteMeta(dir string, meta GenMeta) bool {
+    data, _ := yaml.Marshal(meta)
+    err := os.WriteFile(filepath.Join(dir, "_meta"), data, 0644)
+    if err != nil {
+        logError("Could not write metadata to " + dir + ": " + err.Error())
+        return false
+    }
+    return true
 }
 
-func genSetCurrent(gens string, num int) {
-    genTag(gens, num, "current")
+func genGetMeta(num int) (GenMeta, bool) {
+    data, ok := genReadFile(num, "_meta")
+    if ! ok {
+        return GenMeta{}, false
+    }
+    return genParseMeta(data)
 }
 
-func genSetLatest(gens string, num int) {
-    genTag(gens, num, "latest")
+func genSetMeta(num int, meta GenMeta) bool {
+    data, _ := yaml.Marshal(meta)
+    return genWriteFile(num, "_meta", data)
 }
 
-func genGetCurrent(gens string) int {
-    return genGetTagged(gens, "current")
+// storage is part of the hash, the one stored in the metadata follows it
+func genRefreshHash(num int) {
+    if meta, ok := genGetMeta(num); ok {
+        meta.Hash = genGetHash(num)
+        genSetMeta(num, meta)
+    }
 }
 
-func genGetLatest(gens string) int {
-    return genGetTagged(gens, "latest")
+func genRecordSwitch(num int) {
+    meta, _ := genGetMeta(num)
+    meta.Switched = append(meta.Switched, time.Now().Truncate(time.Second))
+    genSetMeta(num, meta)
 }
 
-func genExists(gens string, num int) bool {
-    return fileExists(filepath.Join(gens, strconv.Itoa(num)))
+// build time, falls back to the modification time of the stores having one for generations without metadata
+func genGetBuilt(num int) time.Time {
+    meta, ok := genGetMeta(num)
+    if ok && ! meta.Built.IsZero() {
+        return meta.Built
+    }
+    if ms, ok := store.(modTimeStore); ok {
+        return ms.modTime(num)
+    }
+    return time.Time{}
 }
 
-func genDiff(gens string, a int, b int, h Handler) ([]string, []string) {
+// last time the generation became the current one
+func genLastSwitched(meta GenMeta) (time.Time, bool) {
+    if len(meta.Switched) == 0 {
+        return time.Time{}, false
+    }
+    return meta.Switched[len(meta.Switched) - 1], true
+}
+
+// the tag is replaced atomically, it never goes missing
+func genTag(num int, tag string) bool {
+    return store.Tag(num, tag)
+}
+
+// returns -1 if the tag is missing or broken
+func genGetTagged(tag string) int {
+    return store.Tagged(tag)
+}
+
+func genUntag(tag string) bool {
+    return store.Untag(tag)
+}
+
+// current and latest included
+func genGetTags() map[string]int {
+    return store.Tags()
+}
+
+// tags set by the user on a generation, these generations are pinned and can not be deleted
+func genGetUserTags(num int) []string {
+    var tags []string
+    for tag, g := range genGetTags() {
+        if g == num && ! genIsBuiltinTag(tag) {
+            tags = append(tags, tag)
+        }
+    }
+    slices.Sort(tags)
+    return tags
+}
+
+func genIsBuiltinTag(tag string) bool {
+    return tag == "current" || tag == "latest"
+}
+
+func genIsValidTagName(tag string) bool {
+    tagRegex, _ := regexp.Compile("^[A-Za-z][A-Za-z0-9._-]*$")
+    return tagRegex.MatchString(tag)
+}
+
+func genSetCurrent(num int) bool {
+    return genTag(num, "current")
+}
+
+func genSetLatest(num int) bool {
+    return genTag(num, "latest")
+}
+
+func genGetCurrent() int {
+    return genGetTagged("current")
+}
+
+func genGetLatest() int {
+    return genGetTagged("latest")
+}
+
+func genExists(num int) bool {
+    return store.Exists(num)
+}
+
+func genDiff(a int, b int, h Handler) ([]string, []string) {
     var add []string
     var remove []string
 
-    inGenA := handlerGetEntries(gens, a, h)
-    inGenB := handlerGetEntries(gens, b, h)
+    // same blob in both trees, nothing to read
+    if sf, ok := store.(sameFileStore); ok && sf.sameFile(a, b, h.Name) {
+        return add, remove
+    }
+
+    inGenA := handlerGetEntries(a, h)
+    inGenB := handlerGetEntries(b, h)
 
     // in a and not in b => remove
     for _, entry := range inGenA {
@@ -80,36 +253,67 @@ func genDiff(gens string, a int, b int, h Handler) ([]string, []string) {
     return add, remove
 }
 
-func genParse(gens string, arg string) int {
-    if arg == "current" {
-        return genGetCurrent(gens)
-    } else if arg == "latest" {
-        return genGetLatest(gens)
-    } else {
-        num, err := strconv.Atoi(arg)
-        if err != nil || ! genExists(gens, num) {
-            return -1
+// for keyvalue handlers, the value of a key present in both generations
+type Change struct {
+    Key string `yaml:"key" json:"key"`
+    Old string `yaml:"old" json:"old"`
+    New string `yaml:"new" json:"new"`
+}
+
+// like genDiff, but entries are compared by key
+// entries whose key is in both generations with a different value are changes, not add/remove
+func genDiffKeyValue(a int, b int, h Handler) ([]string, []Change, []string) {
+    var add []string
+    var change []Change
+    var remove []string
+
+    inGenA := make(map[string]string)
+    for _, entry := range handlerGetEntries(a, h) {
+        key, value := handlerSplitEntry(h, entry)
+        inGenA[key] = value
+    }
+    inGenB := make(map[string]string)
+    for _, entry := range handlerGetEntries(b, h) {
+        key, value := handlerSplitEntry(h, entry)
+        inGenB[key] = value
+    }
+
+    for _, entry := range handlerGetEntries(a, h) {
+        key, value := handlerSplitEntry(h, entry)
+        newValue, ok := inGenB[key]
+        if ! ok {
+            remove = append(remove, entry)
+        } else if newValue != value {
+            change = append(change, Change{key, value, newValue})
         }
-        return num
     }
+    for _, entry := range handlerGetEntries(b, h) {
+        key, _ := handlerSplitEntry(h, entry)
+        if _, ok := inGenA[key]; ! ok {
+            add = append(add, entry)
+        }
+    }
+
+    return add, change, remove
 }
 
-func genGetComment(gens string, num int) string {
-    if genExists(gens, num) {
-        commentFilePath := filepath.Join(genGetPath(gens, num), "_comment")
-        if fileExists(commentFilePath) {
-            commentFile, _ := os.Open(commentFilePath)
-            scanner := bufio.NewScanner(commentFile)
-            comment := ""
-            for scanner.Scan() {
-                comment = scanner.Text()
-                // on ne lit que la premiere ligne
-                break
-            }
-            return string(comment)
-        }
+// numbers, tags and the references of ref.go
+func genParse(gens string, arg string) int {
+    num := refResolve(gens, arg)
+    if num == -1 || ! genExists(num) {
+        return -1
     }
-    return ""
+    return num
+}
+
+func genGetComment(num int) string {
+    data, ok := genReadFile(num, "_comment")
+    if ! ok {
+        return ""
+    }
+    // on ne lit que la premiere ligne
+    comment, _, _ := strings.Cut(string(data), "\n")
+    return comment
 }
 
 // todo genDelete = uniquement suppression
@@ -120,110 +324,305 @@ func genDelete(gens string, num int) bool {
         return false
     }
 
-    if num == genGetCurrent(gens) {
+    if num == genGetCurrent() {
         logError("Deleting the current generation is forbidden")
         return false
     }
 
-    if ! genExists(gens, num) {
+    if ! genExists(num) {
         logError("Generation " + strconv.Itoa(num) + " does not exist")
         return false
     }
+
+    if tags := genGetUserTags(num); len(tags) > 0 {
+        logError("Generation " + strconv.Itoa(num) + " is pinned by tag " + strings.Join(tags, ", ") + ", untag it first")
+        return false
+    }
     
-    if num == genGetLatest(gens) {
+    if num == genGetLatest() {
         prevGen := num - 1
-        for ! genExists(gens, prevGen) {
+        for ! genExists(prevGen) {
             prevGen = prevGen - 1
             // on tombe sur la generation 0 au bout d'un moment
         }
-        genSetLatest(gens, prevGen)
+        genSetLatest(prevGen)
         logInfo("The latest generation is now " + strconv.Itoa(prevGen))
     }
 
-    os.RemoveAll(genGetPath(gens, num))
+    if ! store.Delete(num) {
+        return false
+    }
+    historyRecord(gens, "delete", num, -1, "", "")
     logInfo("Deleted generation " + strconv.Itoa(num))
 
     return true
 }
 
-func genGetPath(gens string, num int) string {
-    if genExists(gens, num) {
-        return filepath.Join(gens, strconv.Itoa(num))
+// all the steps a switch would run, without running them
+// a switch runs in two phases: first the removals, from the last handler to the first,
+// so that a handler is still there to remove the entries of the handlers depending on it, then the other steps in handler order
+func genSwitchPlan(config Config, gens string, fromGen int, targetGen int, journal *Journal) ([]SwitchStep, bool) {
+    var plan []SwitchStep
+    predicted := orderPredict(config.Handlers)
+    reversed := slices.Clone(config.Handlers)
+    slices.Reverse(reversed)
+    for _, phase := range []string{"removals", "others"} {
+        handlers := config.Handlers
+        if phase == "removals" {
+            handlers = reversed
+        }
+        for _, h := range handlers {
+            if predicted[h.Name] != "done" {
+                continue
+            }
+            steps, ok := handlerSwitchSteps(h, gens, fromGen, targetGen, journal, phase, nil)
+            if ! ok {
+                return plan, false
+            }
+            plan = append(plan, steps...)
+        }
     }
-    return ""
+    return plan, true
 }
 
-func genSwitch(config Config, gens string, targetGen int, fromGen int, dryRun bool) bool {
+// opens the journal of a new switch, or loads the one of the switch to resume
+// no journal is written on dry runs
+func genSwitchBegin(gens string, fromGen int, targetGen int, dryRun bool, resume bool) (*Journal, bool) {
+    journal := journalLoad(gens)
+    if journal != nil && ! resume {
+        logError("The switch from generation " + strconv.Itoa(journal.From) + " to generation " + strconv.Itoa(journal.Target) + " did not complete")
+        logError("Run `eugene switch --resume` to finish it or `eugene switch --abandon` to discard it")
+        return nil, false
+    }
+    if journal == nil && resume {
+        logError("There is no interrupted switch to resume")
+        return nil, false
+    }
+    if journal == nil && ! dryRun {
+        journal = journalOpen(gens, fromGen, targetGen)
+        if journal == nil {
+            return nil, false
+        }
+    }
+
     // variables d'environnement pour utilisation dans scripts
     os.Setenv("EUGENE_CURRENT_GEN", strconv.Itoa(fromGen))
     os.Setenv("EUGENE_TARGET_GEN", strconv.Itoa(targetGen))
-    repair := (fromGen == 0)
-    for _, h := range config.Handlers {
-        if ! handlerShouldRun(h) {
-            continue
-        }
-        os.Setenv("EUGENE_HANDLER_NAME", h.Name)
-        if ! handlerSetup(h, gens, dryRun, repair) {
+    return journal, true
+}
+
+// if the current tag can not be updated, the journal is kept so that the switch can be resumed
+func genSwitchEnd(targetGen int, journal *Journal, dryRun bool) bool {
+    if ! dryRun {
+        if ! genSetCurrent(targetGen) {
             return false
         }
-        if ! handlerPreSwitch(h, dryRun) {
-            return false
+        genRecordSwitch(targetGen)
+        journalClose(journal)
+    }
+    return true
+}
+
+// out is where the steps are logged when handlers run in parallel, see handlerExecTo
+func genRunSteps(gens string, steps []SwitchStep, journal *Journal, dryRun bool, out io.Writer) bool {
+    lastAction := ""
+    lastHandler := ""
+    for _, step := range steps {
+        if step.Action != lastAction || step.Handler != lastHandler {
+            logHandlerTo(out, step.Handler, stepDescriptions[step.Action])
+            lastAction = step.Action
+            lastHandler = step.Handler
         }
-        if ! handlerSync(h, dryRun) {
+        if ! handlerStepExec(gens, step, dryRun, out) {
+            detail := step.Action + ": " + step.Command
+            if step.Bisect != "" && len(step.Entries) > 1 {
+                logErrorTo(out, "Handler " + step.Handler + " failed to " + step.Action + " a batch of " + strconv.Itoa(len(step.Entries)) + " entries, retrying in halves")
+                failing, ok := genBisectStep(gens, step, journal, out)
+                if ! ok {
+                    return false
+                }
+                // the halves are already journaled
+                if len(failing) == 0 {
+                    logHandlerTo(out, step.Handler, "The batch failed but no entry failed on its own, every entry is done")
+                    continue
+                }
+                logErrorTo(out, "Handler " + step.Handler + " failed to " + step.Action + ": " + strings.Join(failing, " "))
+                detail = step.Action + ": failing entries " + strings.Join(failing, " ")
+            }
+            if journal != nil {
+                historyRecord(gens, "failure", journal.From, journal.Target, step.Handler, detail)
+            }
             return false
         }
-        add, remove := genDiff(gens, fromGen, targetGen, h)
-        if ! handlerRemove(h, remove, dryRun) {
+        if ! dryRun && ! journalRecord(journal, step.Action, step.Handler, step.Entries) {
             return false
         }
-        if ! handlerAdd(h, add, dryRun) {
-            return false
+    }
+    return true
+}
+
+// the steps are computed right before running, the caller has checked run_if
+func genSwitchHandler(h Handler, gens string, fromGen int, targetGen int, journal *Journal, dryRun bool, phase string, out io.Writer) bool {
+    steps, ok := handlerSwitchSteps(h, gens, fromGen, targetGen, journal, phase, out)
+    if ! ok {
+        return false
+    }
+    return genRunSteps(gens, steps, journal, dryRun, out)
+}
+
+// a handler skipped by the first phase, because its run_if failed back then, still has its removals to run
+func genSwitchSecondPhase(predicted map[string]string, h Handler) string {
+    if predicted[h.Name] != "done" {
+        return "all"
+    }
+    return "others"
+}
+
+// retries a failed batch in halves, down to the entries failing on their own, which are returned
+// the halves that succeed are journaled, so that a resumed switch only retries the failing entries
+func genBisectStep(gens string, step SwitchStep, journal *Journal, out io.Writer) ([]string, bool) {
+    if len(step.Entries) == 1 {
+        return step.Entries, true
+    }
+    var failing []string
+    half := len(step.Entries) / 2
+    for _, entries := range [][]string{step.Entries[:half], step.Entries[half:]} {
+        halfStep := SwitchStep{step.Handler, step.Action, entries, fmt.Sprintf(step.Bisect, strings.Join(entries, " ")), step.Bisect}
+        if handlerStepExec(gens, halfStep, false, out) {
+            if ! journalRecord(journal, halfStep.Action, halfStep.Handler, halfStep.Entries) {
+                return nil, false
+            }
+            continue
         }
-        if ! handlerPostSwitch(h, dryRun) {
+        halfFailing, ok := genBisectStep(gens, halfStep, journal, out)
+        if ! ok {
+            return nil, false
+        }
+        failing = append(failing, halfFailing...)
+    }
+    return failing, true
+}
+
+func genSwitch(config Config, gens string, targetGen int, fromGen int, dryRun bool, resume bool) bool {
+    journal, ok := genSwitchBegin(gens, fromGen, targetGen, dryRun, resume)
+    if ! ok {
+        return false
+    }
+
+    if config.Parallel {
+        if ! parallelSwitch(config, gens, fromGen, targetGen, journal, dryRun) {
             return false
         }
+        return genSwitchEnd(targetGen, journal, dryRun)
     }
 
-    if ! dryRun {
-        genSetCurrent(gens, targetGen)
+    // removals come first, from the last handler to the first, see genSwitchPlan
+    predicted := orderPredict(config.Handlers)
+    for i := len(config.Handlers) - 1; i >= 0; i-- {
+        h := config.Handlers[i]
+        if predicted[h.Name] == "done" && ! genSwitchHandler(h, gens, fromGen, targetGen, journal, dryRun, "removals", nil) {
+            return false
+        }
+    }
+    // run_if is evaluated again, it may depend on what the previous handlers installed
+    status := make(map[string]string)
+    for _, h := range config.Handlers {
+        if name := orderUnmetRequirement(h, status); name != "" {
+            logHandler(h.Name, "Skipped, it requires handler " + name + " which did not run")
+            status[h.Name] = "skipped"
+            continue
+        }
+        if ! handlerShouldRun(h) {
+            status[h.Name] = "not run"
+            continue
+        }
+        if ! genSwitchHandler(h, gens, fromGen, targetGen, journal, dryRun, genSwitchSecondPhase(predicted, h), nil) {
+            return false
+        }
+        status[h.Name] = "done"
     }
 
-    return true
+    return genSwitchEnd(targetGen, journal, dryRun)
 }
 
-func genGetAll(gens string) []int {
-    generationRegex, _ := regexp.Compile("^[0-9]+$")
-    var resultArr []int
+// undoes the remove and add steps recorded in the journal of a failed switch
+// the inverse steps are computed from the diff between the target and the previous generation
+// returns false if any inverse step failed
+func genSwitchUndo(config Config, gens string) bool {
+    journal := journalLoad(gens)
+    if journal == nil {
+        return true
+    }
 
-    allGens, _ := os.ReadDir(gens)
-    for _, g := range allGens {
-        if generationRegex.MatchString(g.Name()) {
-            num, _ := strconv.Atoi(g.Name())
-            resultArr = append(resultArr, num)
+    os.Setenv("EUGENE_CURRENT_GEN", strconv.Itoa(journal.Target))
+    os.Setenv("EUGENE_TARGET_GEN", strconv.Itoa(journal.From))
+    var failed []SwitchStep
+    // handlers are undone in reverse order
+    for i := len(config.Handlers) - 1; i >= 0; i-- {
+        h := config.Handlers[i]
+        removed := journalEntries(journal, "remove", h.Name)
+        added := journalEntries(journal, "add", h.Name)
+        if len(removed) == 0 && len(added) == 0 && len(journalEntries(journal, "change", h.Name)) == 0 {
+            continue
+        }
+
+        // what has been added must be removed and the other way around
+        undoAdd, undoRemove := genDiff(journal.Target, journal.From, h)
+        undoRemove = slices.DeleteFunc(undoRemove, func(e string) bool { return ! slices.Contains(added, e) })
+        undoAdd = slices.DeleteFunc(undoAdd, func(e string) bool { return ! slices.Contains(removed, e) })
+
+        steps := handlerEntriesSteps(h, "remove", undoRemove, h.Remove)
+        changed := journalEntries(journal, "change", h.Name)
+        if handlerIsKeyValue(h) && len(changed) > 0 {
+            _, undoChange, _ := genDiffKeyValue(journal.Target, journal.From, h)
+            undoChange = slices.DeleteFunc(undoChange, func(c Change) bool { return ! slices.Contains(changed, c.Key) })
+            steps = append(steps, handlerChangeSteps(h, undoChange)...)
+        }
+        steps = append(steps, handlerEntriesSteps(h, "add", undoAdd, h.Add)...)
+        lastAction := ""
+        for _, step := range steps {
+            if step.Action != lastAction {
+                logHandler(h.Name, stepDescriptions[step.Action])
+                lastAction = step.Action
+            }
+            if ! handlerStepExec(gens, step, false, nil) {
+                failed = append(failed, step)
+            }
         }
     }
+    journalClose(journal)
 
-    slices.Sort(resultArr)
-    return resultArr
+    for _, step := range failed {
+        logError("Inverse step failed for handler " + step.Handler + ": " + step.Action + " " + strings.Join(step.Entries, " "))
+    }
+    return len(failed) == 0
 }
 
-func genRenumber(gens string, old int, new int) {
-    os.Rename(filepath.Join(gens, strconv.Itoa(old)), filepath.Join(gens, strconv.Itoa(new)))
+// sorted
+func genGetAll() []int {
+    return store.List()
 }
 
-func genGetHash(gens string, num int) string {
-    if ! genExists(gens, num) {
+func genRenumber(old int, new int) bool {
+    return store.Renumber(old, new)
+}
+
+func genGetHash(num int) string {
+    if ! genExists(num) {
         return ""
     }
+    return store.Hash(num)
+}
 
+func genHashDir(dir string) string {
     genHash := sha256.New()
 
-    filepath.Walk(filepath.Join(gens, strconv.Itoa(num)), func(path string, info os.FileInfo, err error) error {
+    filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
         if err != nil {
             panic(err)
         }
         if ! info.IsDir() {
-            if filepath.Base(path) != "_comment" {
+            if filepath.Base(path) != "_comment" && filepath.Base(path) != "_meta" {
                 f, err := os.Open(path)
                 if err != nil {
                     panic(err)
@@ -241,51 +640,65 @@ func genGetHash(gens string, num int) string {
     return fmt.Sprintf("%x", genHash.Sum(nil))
 }
 
-func genStoragePut(gens string, num int, namespace string, key string, value []string) bool {
-    if num == 0 || ! genExists(gens, num) {
+func genStoragePut(num int, namespace string, key string, value []string) bool {
+    if num == 0 || ! genExists(num) {
         return false
     }
-    storagePath := filepath.Join(gens, strconv.Itoa(num), "storage", namespace)
-    if ! fileExists(storagePath) {
-        os.Mkdir(storagePath, os.ModePerm)
-    }
-    keyPath := filepath.Join(storagePath, key)
+    keyPath := "storage/" + namespace + "/" + key
     if len(value) > 0 && value[0] != "" {
-        keyFile, err := os.Create(keyPath)
-        if err != nil {
-            panic(err)
-        }
+        content := ""
         for _, val := range value {
-            keyFile.WriteString(val + "\n")
+            content += val + "\n"
+        }
+        if ! genWriteFile(num, keyPath, []byte(content)) {
+            return false
         }
-        keyFile.Close()
     } else {
         // vide => suppression
-        if fileExists(keyPath) {
-            os.Remove(keyPath)
-            nsContent, _ := os.ReadDir(storagePath)
-            if len(nsContent) == 0 {
-                logInfo("Namespace " + namespace + " now empty, deleting from generation")
-                os.Remove(storagePath)
-            }
+        if _, ok := genReadFile(num, keyPath); ok {
+            genRemoveFile(num, keyPath)
         }
     }
+    genRefreshHash(num)
     return true
 }
 
-func genStorageGet(gens string, num int, namespace string, key string) []string {
-    if num == 0 || ! genExists(gens, num) {
+func genStorageGet(num int, namespace string, key string) []string {
+    if num == 0 || ! genExists(num) {
         return nil
     }
-    keyPath := filepath.Join(gens, strconv.Itoa(num), "storage", namespace, key)
-    if ! fileExists(keyPath) {
+    data, ok := genReadFile(num, "storage/" + namespace + "/" + key)
+    if ! ok {
         return nil
     }
     var res []string
-    keyFile, _ := os.Open(keyPath)
-    scanner := bufio.NewScanner(keyFile)
+    scanner := bufio.NewScanner(strings.NewReader(string(data)))
     for scanner.Scan() {
         res = append(res, scanner.Text())
     }
     return res
-}
\ No newline at end of file
+}
+
+// files of a generation, by their slash separated path relative to the generation
+
+func genReadFile(num int, name string) ([]byte, bool) {
+    return store.ReadFile(num, name)
+}
+
+func genWriteFile(num int, name string, data []byte) bool {
+    return store.WriteFile(num, name, data)
+}
+
+// the directory holding the file is removed with it once empty, like a git tree
+func genRemoveFile(num int, name string) bool {
+    return store.RemoveFile(num, name)
+}
+
+func genListFiles(num int) []string {
+    return store.ListFiles(num)
+}
+
+// copies a generation into a temporary directory, as genCreate makes them
+func genExtract(num int) string {
+    return store.Extract(num)
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// generations kept as commits of a bare git repo under the generations directory, selected with `store: git`
+// generation n is the ref refs/generations/n, its tree holds the same files as a generation directory
+// tags are symbolic refs refs/tags/<tag> pointing to a generation ref
+// the hash of a generation is the hash of its tree, without _comment and _meta
+// the journal, history, lock and setup markers stay files of the generations directory
+
+const gitStoreName = "store.git"
+
+type gitStore struct {
+	gens string
+}
+
+func (s *gitStore) path() string {
+	return filepath.Join(s.gens, gitStoreName)
+}
+
+func (s *gitStore) Kind() string {
+	return "git"
+}
+
+func (s *gitStore) Present() bool {
+	return fileExists(s.path())
+}
+
+func (s *gitStore) Destroy() bool {
+	return os.RemoveAll(s.path()) == nil
+}
+
+func (s *gitStore) complete() bool {
+	return fileExists(filepath.Join(s.path(), "refs", "tags", "current"))
+}
+
+func gitStoreRef(num int) string {
+	return "refs/generations/" + strconv.Itoa(num)
+}
+
+// runs git on the store, the user's git configuration is ignored so that it can not alter the generations
+func (s *gitStore) run(env []string, stdin []byte, args ...string) ([]byte, bool) {
+	cmd := exec.Command("git", append([]string{"--git-dir", s.path()}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_CONFIG_GLOBAL=/dev/null",
+		"GIT_AUTHOR_NAME=eugene",
+		"GIT_AUTHOR_EMAIL=eugene@localhost",
+		"GIT_COMMITTER_NAME=eugene",
+		"GIT_COMMITTER_EMAIL=eugene@localhost",
+	)
+	cmd.Env = append(cmd.Env, env...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return []byte(strings.TrimSpace(stderr.String())), false
+	}
+	return out, true
+}
+
+func (s *gitStore) output(env []string, args ...string) (string, bool) {
+	out, ok := s.run(env, nil, args...)
+	return strings.TrimSpace(string(out)), ok
+}
+
+func (s *gitStore) Init() bool {
+	out, ok := s.output(nil, "init", "--bare", "--quiet")
+	if ! ok {
+		logError("Could not create git store: " + out)
+	}
+	return ok
+}
+
+// a temporary index, so that concurrent readers never see a partial tree
+func (s *gitStore) index(num int) (string, []string) {
+	index := filepath.Join(s.gens, tmpPrefix + "index-" + strconv.Itoa(num))
+	os.Remove(index)
+	return index, []string{"GIT_INDEX_FILE=" + index}
+}
+
+// the hash of the tree without _comment and _meta
+func (s *gitStore) contentHash(treeish string) string {
+	listing, ok := s.output(nil, "ls-tree", treeish)
+	if ! ok {
+		return ""
+	}
+	var content []string
+	for _, line := range strings.Split(listing, "\n") {
+		if line != "" && ! strings.HasSuffix(line, "\t_comment") && ! strings.HasSuffix(line, "\t_meta") {
+			content = append(content, line)
+		}
+	}
+	input := strings.Join(content, "\n")
+	if input != "" {
+		input += "\n"
+	}
+	hash, _ := s.run(nil, []byte(input), "mktree")
+	return strings.TrimSpace(string(hash))
+}
+
+// commits a generation built in a temporary directory, its parent is the latest generation
+func (s *gitStore) Commit(num int, tmpDir string) bool {
+	index, env := s.index(num)
+	defer os.Remove(index)
+
+	out, ok := s.output(env, "--work-tree", tmpDir, "add", "--all", "--force", ".")
+	if ok {
+		// the hash is written in _meta before the final tree is made
+		tree, _ := s.output(env, "write-tree")
+		if meta, hasMeta := genReadMeta(tmpDir); hasMeta {
+			meta.Hash = s.contentHash(tree)
+			genWriteMeta(tmpDir, meta)
+			out, ok = s.output(env, "--work-tree", tmpDir, "add", "--all", "--force", ".")
+		}
+	}
+	tree := ""
+	if ok {
+		tree, ok = s.output(env, "write-tree")
+		out = tree
+	}
+	if ok {
+		args := []string{"commit-tree", tree, "-m", "generation " + strconv.Itoa(num)}
+		if comment, hasComment := gitStoreReadDirComment(tmpDir); hasComment {
+			args[3] = "generation " + strconv.Itoa(num) + ": " + comment
+		}
+		if parent, hasParent := s.output(nil, "rev-parse", "--verify", "--quiet", gitStoreRef(s.Tagged("latest"))); hasParent {
+			args = append(args, "-p", parent)
+		}
+		out, ok = s.output(nil, args...)
+	}
+	if ok {
+		out, ok = s.output(nil, "update-ref", gitStoreRef(num), out)
+	}
+	if ! ok {
+		logError("Could not create generation " + strconv.Itoa(num) + ": " + out)
+	}
+	genDiscard(tmpDir)
+	return ok
+}
+
+func gitStoreReadDirComment(dir string) (string, bool) {
+	data, err := os.ReadFile(filepath.Join(dir, "_comment"))
+	if err != nil {
+		return "", false
+	}
+	comment, _, _ := strings.Cut(string(data), "\n")
+	return comment, comment != ""
+}
+
+// rewrites a file of a generation, as a new commit on top of it
+func (s *gitStore) update(num int, name string, data []byte, remove bool) bool {
+	ref := gitStoreRef(num)
+	index, env := s.index(num)
+	defer os.Remove(index)
+
+	old, ok := s.output(nil, "rev-parse", "--verify", "--quiet", ref)
+	out := "generation does not exist"
+	if ok {
+		out, ok = s.output(env, "read-tree", ref)
+	}
+	if ok && remove {
+		// --force-remove would need a work tree, mode 0 removes the entry without one
+		_, ok = s.run(env, []byte("0 " + strings.Repeat("0", 40) + "\t" + name + "\n"), "update-index", "--index-info")
+		out = "could not remove " + name
+	} else if ok {
+		var blob []byte
+		blob, ok = s.run(nil, data, "hash-object", "-w", "--stdin")
+		out = strings.TrimSpace(string(blob))
+		if ok {
+			out, ok = s.output(env, "update-index", "--add", "--cacheinfo", "100644," + out + "," + name)
+		}
+	}
+	if ok {
+		out, ok = s.output(env, "write-tree")
+	}
+	if ok {
+		out, ok = s.output(nil, "commit-tree", out, "-p", old, "-m", "update " + name)
+	}
+	if ok {
+		out, ok = s.output(nil, "update-ref", ref, out, old)
+	}
+	if ! ok {
+		logError("Could not update " + name + " of generation " + strconv.Itoa(num) + ": " + out)
+	}
+	return ok
+}
+
+func (s *gitStore) WriteFile(num int, name string, data []byte) bool {
+	return s.update(num, name, data, false)
+}
+
+func (s *gitStore) RemoveFile(num int, name string) bool {
+	return s.update(num, name, nil, true)
+}
+
+func (s *gitStore) ReadFile(num int, name string) ([]byte, bool) {
+	return s.run(nil, nil, "cat-file", "blob", gitStoreRef(num) + ":" + name)
+}
+
+func (s *gitStore) ListFiles(num int) []string {
+	out, ok := s.run(nil, nil, "ls-tree", "-r", "-z", "--name-only", gitStoreRef(num))
+	if ! ok {
+		return nil
+	}
+	var files []string
+	for _, f := range strings.Split(string(out), "\x00") {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// whether a file is identical in two generations, without reading it
+func (s *gitStore) sameFile(a int, b int, name string) bool {
+	blobA, okA := s.output(nil, "rev-parse", "--verify", "--quiet", gitStoreRef(a) + ":" + name)
+	blobB, okB := s.output(nil, "rev-parse", "--verify", "--quiet", gitStoreRef(b) + ":" + name)
+	return okA == okB && blobA == blobB
+}
+
+func (s *gitStore) List() []int {
+	out, _ := s.output(nil, "for-each-ref", "--format=%(refname:lstrip=2)", "refs/generations/")
+	var nums []int
+	for _, name := range strings.Fields(out) {
+		if num, err := strconv.Atoi(name); err == nil {
+			nums = append(nums, num)
+		}
+	}
+	slices.Sort(nums)
+	return nums
+}
+
+func (s *gitStore) Exists(num int) bool {
+	_, ok := s.output(nil, "rev-parse", "--verify", "--quiet", gitStoreRef(num))
+	return ok
+}
+
+func (s *gitStore) Hash(num int) string {
+	return s.contentHash(gitStoreRef(num))
+}
+
+func (s *gitStore) Delete(num int) bool {
+	out, ok := s.output(nil, "update-ref", "-d", gitStoreRef(num))
+	if ! ok {
+		logError("Could not delete generation " + strconv.Itoa(num) + ": " + out)
+	}
+	return ok
+}
+
+func (s *gitStore) Renumber(old int, new int) bool {
+	commit, ok := s.output(nil, "rev-parse", "--verify", "--quiet", gitStoreRef(old))
+	out := "generation does not exist"
+	if ok {
+		// the new ref must not exist yet
+		out, ok = s.output(nil, "update-ref", gitStoreRef(new), commit, "")
+	}
+	if ok {
+		out, ok = s.output(nil, "update-ref", "-d", gitStoreRef(old))
+	}
+	if ! ok {
+		logError("Could not renumber generation " + strconv.Itoa(old) + " to " + strconv.Itoa(new) + ": " + out)
+	}
+	return ok
+}
+
+func (s *gitStore) Tag(num int, tag string) bool {
+	out, ok := s.output(nil, "symbolic-ref", "refs/tags/" + tag, gitStoreRef(num))
+	if ! ok {
+		logError("Could not tag generation " + strconv.Itoa(num) + " as " + tag + ": " + out)
+	}
+	return ok
+}
+
+func (s *gitStore) Tagged(tag string) int {
+	target, ok := s.output(nil, "symbolic-ref", "--quiet", "refs/tags/" + tag)
+	if ! ok || ! strings.HasPrefix(target, "refs/generations/") {
+		return -1
+	}
+	num, err := strconv.Atoi(strings.TrimPrefix(target, "refs/generations/"))
+	if err != nil {
+		return -1
+	}
+	return num
+}
+
+func (s *gitStore) Untag(tag string) bool {
+	out, ok := s.output(nil, "symbolic-ref", "--delete", "refs/tags/" + tag)
+	if ! ok {
+		logError("Could not remove tag " + tag + ": " + out)
+	}
+	return ok
+}
+
+func (s *gitStore) Tags() map[string]int {
+	tags := make(map[string]int)
+	// symbolic refs are never packed, they are all files of refs/tags
+	entries, _ := os.ReadDir(filepath.Join(s.path(), "refs", "tags"))
+	for _, e := range entries {
+		if ! e.IsDir() && ! strings.HasSuffix(e.Name(), ".lock") {
+			tags[e.Name()] = s.Tagged(e.Name())
+		}
+	}
+	return tags
+}
+
+// checks a generation out in a temporary directory
+func (s *gitStore) Extract(num int) string {
+	tmpDir, err := storeTempDir(s.gens, strconv.Itoa(num))
+	if err != nil {
+		logError("Could not extract generation " + strconv.Itoa(num) + ": " + err.Error())
+		return ""
+	}
+	index, env := s.index(num)
+	defer os.Remove(index)
+	out, ok := s.output(env, "read-tree", gitStoreRef(num))
+	if ok {
+		out, ok = s.output(env, "--work-tree", tmpDir, "checkout-index", "--all", "--force")
+	}
+	if ! ok {
+		logError("Could not extract generation " + strconv.Itoa(num) + ": " + out)
+		genDiscard(tmpDir)
+		return ""
+	}
+	return tmpDir
+}
+
+// the repository itself, and the directory store left by an interrupted migration from it
+func (s *gitStore) check(fix bool) int {
+	problems := 0
+	if out, ok := s.output(nil, "fsck", "--no-dangling", "--no-progress"); ! ok {
+		fsckReport("The git store is corrupted: " + out, false)
+		problems++
+	}
+	if leftovers := storeDirFiles(s.gens); len(leftovers) > 0 {
+		msg := "Generations directory store leftovers of a migration: " + strings.Join(leftovers, ", ")
+		fixed := fix && (&dirStore{s.gens}).Destroy()
+		fsckReport(msg, fixed)
+		if ! fixed {
+			problems++
+		}
+	}
+	return problems
+}
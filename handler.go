@@ -2,126 +2,335 @@ package main
 
 import (
     "fmt"
+    "io"
     "strings"
     "os"
     "bufio"
     "path/filepath"
+    "slices"
+    "regexp"
 )
 
 func handlerExec(cmd string, dryRun bool) bool {
-    logCommand(cmd, dryRun)
+    return handlerExecTo(nil, nil, cmd, dryRun)
+}
+
+// out receives the command line and both outputs of the command, when handlers run in parallel
+// without it, the command runs like any other, attached to the terminal
+func handlerExecTo(out io.Writer, env []string, cmd string, dryRun bool) bool {
+    logCommandTo(out, cmd, dryRun)
     if dryRun {
         return true
-    } else {
-        return commandExec(cmd)
     }
+    return handlerRunTo(out, env, cmd)
 }
 
-func handlerExecEntries(h Handler, entries []string, cmd string, dryRun bool) bool {
-    if len(entries) < 1 {
-        logHandler(h.Name, ">> Skipped, nothing to do")
-        return true
+// runs a command without logging it, eg. run_if
+// handlers running in parallel get no standard input, nobody could answer a prompt
+func handlerRunTo(out io.Writer, env []string, cmd string) bool {
+    if out == nil {
+        return commandExec(cmd, env)
     }
-    if cmd == "" {
-        logHandler(h.Name, ">> Skipped, command undefined")
-        return true
+    return executor.Run(Command{Shell: cmd, Env: env, Stdout: out, Stderr: out}).ExitCode == 0
+}
+
+// added to the environment of the commands of a handler
+func handlerEnv(name string) []string {
+    return []string{"EUGENE_HANDLER_NAME=" + name}
+}
+
+// a switch step is a single command run by a handler
+// setup, pre, sync and post steps have no entries
+type SwitchStep struct {
+    Handler string `yaml:"handler" json:"handler"`
+    Action string `yaml:"action" json:"action"`
+    Entries []string `yaml:"entries,omitempty" json:"entries,omitempty"`
+    Command string `yaml:"command" json:"command"`
+    // the command of the batch, to retry it with fewer entries, see genBisectStep
+    Bisect string `yaml:"bisect,omitempty" json:"bisect,omitempty"`
+}
+
+var stepDescriptions = map[string]string{
+    "setup": "Setting up",
+    "pre": "Running pre-switch command",
+    "sync": "Synchronizing",
+    "remove": "Removing previous entries",
+    "add": "Adding new entries",
+    "change": "Changing modified entries",
+    "post": "Running post-switch command",
+}
+
+// keyvalue handlers manage entries identified by a key, eg. `org.gnome.desktop.interface gtk-theme='Adwaita'`
+// the key is everything before the first separator
+func handlerIsKeyValue(h Handler) bool {
+    return h.Kind == "keyvalue"
+}
+
+func handlerSeparator(h Handler) string {
+    if h.Separator == "" {
+        return "="
+    }
+    return h.Separator
+}
+
+func handlerSplitEntry(h Handler, entry string) (string, string) {
+    key, value, _ := strings.Cut(entry, handlerSeparator(h))
+    return key, value
+}
+
+// replaces %s with the entry, and for keyvalue handlers %k, %v and %old with the key, the value and the previous value
+func handlerExpand(h Handler, cmd string, entry string, old string) string {
+    if ! handlerIsKeyValue(h) {
+        return fmt.Sprintf(cmd, entry)
     }
-    if h.Multiple {
-        return handlerExec(fmt.Sprintf(cmd, strings.Join(entries, " ")), dryRun)
+    key, value := handlerSplitEntry(h, entry)
+    return strings.NewReplacer("%old", old, "%k", key, "%v", value, "%s", entry).Replace(cmd)
+}
+
+func handlerEntriesSteps(h Handler, action string, entries []string, cmd string) []SwitchStep {
+    var steps []SwitchStep
+    if len(entries) < 1 || cmd == "" {
+        return steps
+    }
+    if h.Multiple && ! handlerIsKeyValue(h) {
+        // one command per batch of entries, all at once without batch_size
+        batchSize := h.BatchSize
+        if batchSize < 1 {
+            batchSize = len(entries)
+        }
+        bisect := ""
+        if h.OnBatchFailure == "bisect" {
+            bisect = cmd
+        }
+        for i := 0; i < len(entries); i += batchSize {
+            end := i + batchSize
+            if end > len(entries) {
+                end = len(entries)
+            }
+            batch := entries[i:end]
+            steps = append(steps, SwitchStep{h.Name, action, batch, fmt.Sprintf(cmd, strings.Join(batch, " ")), bisect})
+        }
     } else {
         for _, entry := range entries {
-            if ! handlerExec(fmt.Sprintf(cmd, entry), dryRun) {
-                return false
-            }
+            steps = append(steps, SwitchStep{h.Name, action, []string{entry}, handlerExpand(h, cmd, entry, ""), ""})
         }
-        return true
     }
+    return steps
 }
 
-func handlerSync(h Handler, dryRun bool) bool {
-    logHandler(h.Name, "Synchronizing")
-    cmd := h.Sync
-    if cmd == "" {
-        logHandler(h.Name, ">> Skipped, command undefined")
-        return true
-    } else {
-        return handlerExec(cmd, dryRun)
+// change steps are journaled with the key of the entry
+func handlerChangeSteps(h Handler, changes []Change) []SwitchStep {
+    var steps []SwitchStep
+    if h.Change == "" {
+        return steps
     }
+    for _, c := range changes {
+        entry := c.Key + handlerSeparator(h) + c.New
+        steps = append(steps, SwitchStep{h.Name, "change", []string{c.Key}, handlerExpand(h, h.Change, entry, c.Old), ""})
+    }
+    return steps
+}
+
+func handlerSetupCommand(h Handler, out io.Writer) (string, bool) {
+    for _, setup := range h.Setup {
+        if handlerRunTo(out, handlerEnv(h.Name), setup.When) {
+            return setup.Run, true
+        }
+    }
+    return "", false
 }
 
-func handlerAdd(h Handler, entries []string, dryRun bool) bool {
-    logHandler(h.Name, "Adding new entries")
-    return handlerExecEntries(h, entries, h.Add, dryRun)
+func handlerSetupFile(gens string, name string) string {
+    return filepath.Join(gens, ".setup-" + name)
+}
+
+// steps already recorded in the journal are left out
+// phase is "removals" for the remove steps only, "others" for every other step, or "all", see genSwitchPlan
+// out is where the handler logs when running in parallel, see handlerExecTo
+func handlerSwitchSteps(h Handler, gens string, fromGen int, targetGen int, j *Journal, phase string, out io.Writer) ([]SwitchStep, bool) {
+    var steps []SwitchStep
+    repair := (fromGen == 0)
+    removals := (phase != "others")
+    others := (phase != "removals")
+
+    if others && h.Setup != nil && (repair || ! fileExists(handlerSetupFile(gens, h.Name))) && ! journalDone(j, "setup", h.Name) {
+        cmd, ok := handlerSetupCommand(h, out)
+        if ! ok {
+            logHandlerTo(out, h.Name, "No setup command matches this system")
+            return nil, false
+        }
+        steps = append(steps, SwitchStep{h.Name, "setup", nil, cmd, ""})
+    }
+    if others && h.HookPre != "" && ! journalDone(j, "pre", h.Name) {
+        steps = append(steps, SwitchStep{h.Name, "pre", nil, h.HookPre, ""})
+    }
+    if others && h.Sync != "" && ! journalDone(j, "sync", h.Name) {
+        steps = append(steps, SwitchStep{h.Name, "sync", nil, h.Sync, ""})
+    }
+
+    var add, remove []string
+    var changes []Change
+    if handlerIsKeyValue(h) {
+        add, changes, remove = genDiffKeyValue(fromGen, targetGen, h)
+        if h.Change == "" {
+            // without change command, the previous value is removed and the new one added
+            for _, c := range changes {
+                remove = append(remove, c.Key + handlerSeparator(h) + c.Old)
+                add = append(add, c.Key + handlerSeparator(h) + c.New)
+            }
+            changes = nil
+        }
+    } else {
+        add, remove = genDiff(fromGen, targetGen, h)
+    }
+    if others && repair && h.Query != "" {
+        // only add what is actually missing
+        installed, ok := handlerQueryTo(out, h)
+        if ! ok {
+            logHandlerTo(out, h.Name, "Query command failed")
+            return nil, false
+        }
+        add = slices.DeleteFunc(add, func(e string) bool { return slices.Contains(installed, e) })
+    }
+    if removals {
+        remove = journalPending(j, "remove", h.Name, remove)
+        steps = append(steps, handlerEntriesSteps(h, "remove", remove, h.Remove)...)
+    }
+    if ! others {
+        return steps, true
+    }
+    add = journalPending(j, "add", h.Name, add)
+    changed := journalEntries(j, "change", h.Name)
+    changes = slices.DeleteFunc(changes, func(c Change) bool { return slices.Contains(changed, c.Key) })
+    steps = append(steps, handlerChangeSteps(h, changes)...)
+    steps = append(steps, handlerEntriesSteps(h, "add", add, h.Add)...)
+
+    if h.HookPost != "" && ! journalDone(j, "post", h.Name) {
+        steps = append(steps, SwitchStep{h.Name, "post", nil, h.HookPost, ""})
+    }
+    return steps, true
 }
 
-func handlerRemove(h Handler, entries []string, dryRun bool) bool {
-    logHandler(h.Name, "Removing previous entries")
-    return handlerExecEntries(h, entries, h.Remove, dryRun)
+func handlerStepExec(gens string, step SwitchStep, dryRun bool, out io.Writer) bool {
+    if ! handlerExecTo(out, handlerEnv(step.Handler), step.Command, dryRun) {
+        return false
+    }
+    if step.Action == "setup" && ! dryRun {
+        f, err := os.Create(handlerSetupFile(gens, step.Handler))
+        if err != nil {
+            logErrorTo(out, "Could not mark handler " + step.Handler + " as set up: " + err.Error())
+            return false
+        }
+        f.Close()
+    }
+    return true
 }
 
 func handlerShouldRun(h Handler) bool {
+    return handlerShouldRunTo(nil, h)
+}
+
+func handlerShouldRunTo(out io.Writer, h Handler) bool {
     if h.RunIf == "" {
         return true
     }
-    return commandExec(h.RunIf)
+    return handlerRunTo(out, handlerEnv(h.Name), h.RunIf)
 }
 
-func handlerSetup(h Handler, gens string, dryRun bool, repair bool) bool {
-    setupFile := filepath.Join(gens, ".setup-" + h.Name)
-    if repair || ! fileExists(setupFile) {
-        if h.Setup != nil {
-            logHandler(h.Name, "Setting up")
+// files of the repo matching the handler, ie. `name*` and `hostname_name*`
+func handlerGetRepoFiles(repo string, h Handler) []string {
+    hostname, _ := os.Hostname()
+    filesRegex, _ := regexp.Compile(fmt.Sprintf("^%s.*$", h.Name))
+    filesRegexHostname, _ := regexp.Compile(fmt.Sprintf("^%s_%s.*$", hostname, h.Name))
+    repoFiles, _ := os.ReadDir(repo)
 
-            success := false
-            for _, setup := range h.Setup {
-                if commandExec(setup.When) {
-                    success = handlerExec(setup.Run, dryRun)
-                    break
-                }
-            }
+    var handlerFiles []string
+    for _, f := range repoFiles {
+        if filesRegex.MatchString(f.Name()) || filesRegexHostname.MatchString(f.Name()) {
+            handlerFiles = append(handlerFiles, f.Name())
+        }
+    }
+    return handlerFiles
+}
 
-            if ! success {
-                return false
-            }
+// entries declared in a repo file, comments and empty lines are ignored
+func handlerReadRepoFile(path string) []string {
+    var entries []string
+    commentRegex, _ := regexp.Compile("^#")
+    emptyLineRegex, _ := regexp.Compile("^$")
 
-            if ! dryRun {
-                os.Create(setupFile)
-            }
+    file, err := os.Open(path)
+    if err != nil {
+        return entries
+    }
+    scanner := bufio.NewScanner(file)
+    for scanner.Scan() {
+        line := scanner.Text()
+        if ! emptyLineRegex.MatchString(line) && ! commentRegex.MatchString(line) {
+            entries = append(entries, line)
         }
     }
-    return true
+    file.Close()
+    return entries
 }
 
-func handlerGetEntries(gens string, num int, h Handler) []string {
+func handlerGetEntries(num int, h Handler) []string {
     var entries []string
 
-    handlerPath := filepath.Join(genGetPath(gens, num), h.Name)
-    if fileExists(handlerPath) {
-        handlerFile, _ := os.Open(handlerPath)
-        scanner := bufio.NewScanner(handlerFile)
+    data, ok := genReadFile(num, h.Name)
+    if ok {
+        scanner := bufio.NewScanner(strings.NewReader(string(data)))
         for scanner.Scan() {
             entries = append(entries, scanner.Text())
         }
-        handlerFile.Close()
     }
 
     return entries
 }
 
-func handlerPreSwitch(h Handler, dryRun bool) bool {
-    if h.HookPre != "" {
-        logHandler(h.Name, "Running pre-switch command")
-        return handlerExec(h.HookPre, dryRun)
+// lists the entries actually present on the system
+func handlerQuery(h Handler) ([]string, bool) {
+    return handlerQueryTo(nil, h)
+}
+
+// out receives the standard error of the query, see handlerExecTo
+func handlerQueryTo(out io.Writer, h Handler) ([]string, bool) {
+    var installed []string
+    lines, ok := commandOutput(h.Query, handlerEnv(h.Name), out)
+    if ! ok {
+        return nil, false
     }
-    return true
+    for _, l := range lines {
+        l = strings.TrimSpace(l)
+        if l != "" {
+            installed = append(installed, l)
+        }
+    }
+    return installed, true
 }
 
-func handlerPostSwitch(h Handler, dryRun bool) bool {
-    if h.HookPost != "" {
-        logHandler(h.Name, "Running post-switch command")
-        return handlerExec(h.HookPost, dryRun)
+// compares the entries of the generation with the ones present on the system
+func handlerDrift(num int, h Handler) ([]string, []string, bool) {
+    var missing []string
+    var extras []string
+
+    installed, ok := handlerQuery(h)
+    if ! ok {
+        return nil, nil, false
     }
-    return true
+    declared := handlerGetEntries(num, h)
+
+    for _, entry := range declared {
+        if ! slices.Contains(installed, entry) {
+            missing = append(missing, entry)
+        }
+    }
+    for _, entry := range installed {
+        if ! slices.Contains(declared, entry) {
+            extras = append(extras, entry)
+        }
+    }
+    return missing, extras, true
 }
 
 func handlerUpgrade(h Handler, dryRun bool) bool {
@@ -130,6 +339,6 @@ func handlerUpgrade(h Handler, dryRun bool) bool {
         logHandler(h.Name, "Command undefined")
         return true
     } else {
-        return handlerExec(h.Upgrade, dryRun)
+        return handlerExecTo(nil, handlerEnv(h.Name), h.Upgrade, dryRun)
     }
 }
\ No newline at end of file
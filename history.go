@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// append-only log of what happened to the generations, browsed with `eugene log`
+// one event per line: time, event, from, to, handler and detail, separated with tabs
+// from and to are -1 when they do not apply
+
+const historyFileName = ".history"
+
+type HistoryEvent struct {
+	Time    time.Time `json:"time" yaml:"time"`
+	Event   string    `json:"event" yaml:"event"`
+	From    int       `json:"from" yaml:"from"`
+	To      int       `json:"to" yaml:"to"`
+	Handler string    `json:"handler" yaml:"handler"`
+	Detail  string    `json:"detail" yaml:"detail"`
+}
+
+func historyField(s string) string {
+	return strings.NewReplacer("\t", " ", "\n", " ").Replace(s)
+}
+
+func historyRecord(gens string, event string, from int, to int, handler string, detail string) bool {
+	line := strings.Join([]string{
+		time.Now().Truncate(time.Second).Format(time.RFC3339),
+		event,
+		strconv.Itoa(from),
+		strconv.Itoa(to),
+		historyField(handler),
+		historyField(detail),
+	}, "\t")
+	f, err := os.OpenFile(filepath.Join(gens, historyFileName), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		logError("Could not write to history: " + err.Error())
+		return false
+	}
+	defer f.Close()
+	_, err = f.WriteString(line + "\n")
+	if err != nil {
+		logError("Could not write to history: " + err.Error())
+		return false
+	}
+	return true
+}
+
+// oldest first, malformed lines are skipped
+func historyRead(gens string) []HistoryEvent {
+	var events []HistoryEvent
+	f, err := os.Open(filepath.Join(gens, historyFileName))
+	if err != nil {
+		return events
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 6 {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, fields[0])
+		from, errFrom := strconv.Atoi(fields[2])
+		to, errTo := strconv.Atoi(fields[3])
+		if err != nil || errFrom != nil || errTo != nil {
+			continue
+		}
+		events = append(events, HistoryEvent{t, fields[1], from, to, fields[4], fields[5]})
+	}
+	return events
+}
+
+// handlers whose entries differ between two generations, recorded with switches
+func historyChangedHandlers(config Config, from int, to int) string {
+	var changed []string
+	for _, h := range config.Handlers {
+		if ! handlerShouldRun(h) {
+			continue
+		}
+		add, remove := genDiff(from, to, h)
+		if len(add) > 0 || len(remove) > 0 {
+			changed = append(changed, h.Name)
+		}
+	}
+	return strings.Join(changed, " ")
+}
+
+func historyRecordSwitch(config Config, gens string, event string, from int, to int) bool {
+	return historyRecord(gens, event, from, to, historyChangedHandlers(config, from, to), "")
+}
+
+// the generations that were current before the current one, oldest first
+// a switch pushes the generation it left, a rollback goes back down the stack
+// generations switched to before the history existed are taken from their switch times
+func historyPreviousGens(gens string) []int {
+	var previous []int
+	hasSwitches := false
+	for _, e := range historyRead(gens) {
+		switch e.Event {
+		case "switch":
+			previous = append(previous, e.From)
+			hasSwitches = true
+		case "rollback":
+			i := len(previous) - 1
+			for i >= 0 && previous[i] != e.To {
+				i--
+			}
+			if i != -1 {
+				previous = previous[:i]
+			} else {
+				// rolled back by number to a generation that was never current
+				previous = append(previous, e.From)
+			}
+			hasSwitches = true
+		case "align":
+			for i, g := range previous {
+				if g == e.From {
+					previous[i] = e.To
+				}
+			}
+		case "delete":
+			previous = slices.DeleteFunc(previous, func(g int) bool {
+				return g == e.From
+			})
+		}
+	}
+
+	if ! hasSwitches {
+		type switchTime struct {
+			num int
+			t   time.Time
+		}
+		var switches []switchTime
+		for _, num := range genGetAll() {
+			meta, _ := genGetMeta(num)
+			for _, t := range meta.Switched {
+				switches = append(switches, switchTime{num, t})
+			}
+		}
+		slices.SortStableFunc(switches, func(a switchTime, b switchTime) int {
+			return a.t.Compare(b.t)
+		})
+		previous = []int{0}
+		for _, s := range switches {
+			previous = append(previous, s.num)
+		}
+	}
+
+	// the same generation twice in a row is a single visit, the current generation is not a previous one
+	previous = slices.Compact(previous)
+	currentGen := genGetCurrent()
+	for len(previous) > 0 && previous[len(previous) - 1] == currentGen {
+		previous = previous[:len(previous) - 1]
+	}
+	return previous
+}
+
+// a duration before now (eg. 7d, 12h) or a date
+func historyParseSince(since string) (time.Time, bool) {
+	if age, ok := gcParseAge(since); ok {
+		return time.Now().Add(-age), true
+	}
+	for _, layout := range []string{time.DateTime, "2006-01-02 15:04", time.DateOnly} {
+		t, err := time.ParseInLocation(layout, since, time.Local)
+		if err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func historyFilter(events []HistoryEvent, since time.Time, handler string) []HistoryEvent {
+	filtered := []HistoryEvent{}
+	for _, e := range events {
+		if e.Time.Before(since) {
+			continue
+		}
+		if handler != "" && ! slices.Contains(strings.Fields(e.Handler), handler) {
+			continue
+		}
+		filtered = append(filtered, e)
+	}
+	return filtered
+}
+
+func historyDescribe(e HistoryEvent) string {
+	from := strconv.Itoa(e.From)
+	to := strconv.Itoa(e.To)
+	switch e.Event {
+	case "build":
+		return "built generation " + to + ": " + e.Detail
+	case "switch":
+		return "switched from generation " + from + " to generation " + to
+	case "rollback":
+		return "rolled back from generation " + from + " to generation " + to
+	case "repair":
+		return "repaired the system to generation " + to
+	case "undo":
+		return "undid the switch from generation " + from + " to generation " + to
+	case "delete":
+		return "deleted generation " + from
+	case "align":
+		return "renumbered generation " + from + " to " + to
+	case "import":
+		return "imported generation " + from + " of " + e.Detail + " as generation " + to
+	case "failure":
+		return "handler " + e.Handler + " failed while switching from generation " + from + " to generation " + to + ": " + e.Detail
+	}
+	return e.Event + " " + e.Detail
+}
+
+func doLog(gens string, since time.Time, handler string) {
+	for _, e := range historyFilter(historyRead(gens), since, handler) {
+		line := e.Time.Local().Format(time.DateTime) + " " + historyDescribe(e)
+		if e.Event == "failure" {
+			line = textRed + line + textReset
+		} else if e.Handler != "" {
+			line += textCyan + " (" + strings.ReplaceAll(e.Handler, " ", ", ") + ")" + textReset
+		}
+		fmt.Println(line)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// while a switch is running, every completed step is appended to the journal
+// if the switch fails, the journal stays in the generations directory
+// and `eugene switch --resume` continues from where it stopped
+
+const journalFileName = ".journal"
+
+// steps of handlers running in parallel are recorded concurrently
+type Journal struct {
+	mu      sync.Mutex
+	path    string
+	From    int
+	Target  int
+	done    map[string]bool
+	entries map[string][]string
+}
+
+func journalKey(action string, handler string) string {
+	return action + "\t" + handler
+}
+
+func journalPath(gens string) string {
+	return filepath.Join(gens, journalFileName)
+}
+
+func journalOpen(gens string, from int, target int) *Journal {
+	j := &Journal{
+		path:    journalPath(gens),
+		From:    from,
+		Target:  target,
+		done:    make(map[string]bool),
+		entries: make(map[string][]string),
+	}
+	err := os.WriteFile(j.path, []byte("switch\t"+strconv.Itoa(from)+"\t"+strconv.Itoa(target)+"\n"), 0644)
+	if err != nil {
+		logError("Could not create switch journal: " + err.Error())
+		return nil
+	}
+	return j
+}
+
+// returns nil if no switch is in progress
+func journalLoad(gens string) *Journal {
+	path := journalPath(gens)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	j := &Journal{
+		path:    path,
+		From:    -1,
+		Target:  -1,
+		done:    make(map[string]bool),
+		entries: make(map[string][]string),
+	}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 2 {
+			continue
+		}
+		if fields[0] == "switch" && len(fields) == 3 {
+			j.From, _ = strconv.Atoi(fields[1])
+			j.Target, _ = strconv.Atoi(fields[2])
+			continue
+		}
+		key := journalKey(fields[0], fields[1])
+		j.done[key] = true
+		j.entries[key] = append(j.entries[key], fields[2:]...)
+	}
+	if j.From == -1 || j.Target == -1 {
+		logError("Switch journal " + path + " is corrupted")
+		return nil
+	}
+	return j
+}
+
+func journalRecord(j *Journal, action string, handler string, entries []string) bool {
+	if j == nil {
+		return true
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	key := journalKey(action, handler)
+	j.done[key] = true
+	j.entries[key] = append(j.entries[key], entries...)
+
+	line := journalKey(action, handler)
+	for _, e := range entries {
+		line += "\t" + e
+	}
+	f, err := os.OpenFile(j.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		logError("Could not write to switch journal: " + err.Error())
+		return false
+	}
+	defer f.Close()
+	_, err = f.WriteString(line + "\n")
+	if err != nil {
+		logError("Could not write to switch journal: " + err.Error())
+		return false
+	}
+	return f.Sync() == nil
+}
+
+func journalDone(j *Journal, action string, handler string) bool {
+	if j == nil {
+		return false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.done[journalKey(action, handler)]
+}
+
+func journalEntries(j *Journal, action string, handler string) []string {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return slices.Clone(j.entries[journalKey(action, handler)])
+}
+
+// entries of the list that were not already handled by a previous attempt
+func journalPending(j *Journal, action string, handler string, entries []string) []string {
+	done := journalEntries(j, action, handler)
+	if len(done) == 0 {
+		return entries
+	}
+	var pending []string
+	for _, e := range entries {
+		if ! slices.Contains(done, e) {
+			pending = append(pending, e)
+		}
+	}
+	return pending
+}
+
+func journalClose(j *Journal) {
+	if j == nil {
+		return
+	}
+	err := os.Remove(j.path)
+	if err != nil && ! os.IsNotExist(err) {
+		logError("Could not remove switch journal: " + err.Error())
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// subcommands that modify the generations directory hold an exclusive lock on it
+// the lock is released by the system when eugene exits, even if it crashes
+
+const lockFileName = ".lock"
+
+// kept open (and referenced) until eugene exits
+var lockFile *os.File
+
+func lockHolder(f *os.File) string {
+	data, err := os.ReadFile(f.Name())
+	if err != nil || strings.TrimSpace(string(data)) == "" {
+		return "another process"
+	}
+	return "process " + strings.TrimSpace(string(data))
+}
+
+func lockAcquire(gens string, wait bool) bool {
+	f, err := os.OpenFile(filepath.Join(gens, lockFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		logError("Could not open lock file: " + err.Error())
+		return false
+	}
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		if ! wait {
+			logError("The generations directory is locked by " + lockHolder(f) + ", use --wait to wait for it")
+			f.Close()
+			return false
+		}
+		logInfo("Waiting for the lock held by " + lockHolder(f))
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	}
+	if err != nil {
+		logError("Could not lock the generations directory: " + err.Error())
+		f.Close()
+		return false
+	}
+
+	f.Truncate(0)
+	f.WriteAt([]byte(strconv.Itoa(os.Getpid()) + "\n"), 0)
+	lockFile = f
+	return true
+}
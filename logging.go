@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"os"
 )
 
 const textReset = "\033[0m"
@@ -13,20 +15,39 @@ const textBold = "\033[1m"
 
 const dryRunIndicator = textYellow + "(dry-run)" + textReset
 
+// logs and command outputs go to stderr when printing structured output
+var logOutput io.Writer = os.Stdout
+
 func logInfo(msg string) {
-	fmt.Println(textGreen + textBold + "info: " + textReset + msg + textReset)
+	fmt.Fprintln(logOutput, textGreen + textBold + "info: " + textReset + msg + textReset)
 }
 
 func logUsage(msg string) {
-	fmt.Println(textRed + textBold + "usage: " + textReset + msg + textReset)
+	fmt.Fprintln(logOutput, textRed + textBold + "usage: " + textReset + msg + textReset)
 }
 
 func logError(msg string) {
-	fmt.Println(textRed + textBold + "error: " + msg + textReset)
+	logErrorTo(logOutput, msg)
+}
+
+// the *To functions write to the output of a handler running in parallel, to the log output when nil
+func logTo(w io.Writer) io.Writer {
+	if w == nil {
+		return logOutput
+	}
+	return w
+}
+
+func logErrorTo(w io.Writer, msg string) {
+	fmt.Fprintln(logTo(w), textRed + textBold + "error: " + msg + textReset)
 }
 
 func logHandler(name string, msg string) {
-	fmt.Println(textCyan + textBold + "handler/" + name + ": " + textReset + msg + textReset)
+	logHandlerTo(logOutput, name, msg)
+}
+
+func logHandlerTo(w io.Writer, name string, msg string) {
+	fmt.Fprintln(logTo(w), textCyan + textBold + "handler/" + name + ": " + textReset + msg + textReset)
 }
 
 func logAction(msg string, dryRun bool) {
@@ -38,5 +59,9 @@ func logAction(msg string, dryRun bool) {
 }
 
 func logCommand(cmd string, dryRun bool) {
-	fmt.Println("$ " + cmd)
+	logCommandTo(logOutput, cmd, dryRun)
+}
+
+func logCommandTo(w io.Writer, cmd string, dryRun bool) {
+	fmt.Fprintln(logTo(w), "$ " + cmd)
 }
\ No newline at end of file
@@ -2,6 +2,7 @@ package main
 
 import (
     "fmt"
+    "io"
     "os"
     "path/filepath"
     "strconv"
@@ -9,6 +10,7 @@ import (
     "strings"
     "os/exec"
     "bufio"
+    "time"
 
     "gopkg.in/yaml.v2"
 )
@@ -20,14 +22,91 @@ func fileExists(f string) bool {
     return err == nil
 }
 
-func commandExec(shellCommand string) bool {
-    cmd := exec.Command("sh", "-c", shellCommand)
-    cmd.Env = os.Environ()
-    cmd.Stdin = os.Stdin
-    cmd.Stdout = os.Stdout
-    cmd.Stderr = os.Stderr
-    err := cmd.Run()
-    return err == nil
+// env is added to the environment of eugene
+func commandExec(shellCommand string, env []string) bool {
+    return executor.Run(Command{Shell: shellCommand, Env: env, Stdin: os.Stdin}).ExitCode == 0
+}
+
+// runs the command and returns its standard output, line by line
+// the standard error goes to stderr, or to the one of eugene when nil
+func commandOutput(shellCommand string, env []string, stderr io.Writer) ([]string, bool) {
+    result := executor.Run(Command{Shell: shellCommand, Env: env, Capture: true, Stderr: stderr})
+    if result.ExitCode != 0 {
+        return nil, false
+    }
+    var lines []string
+    scanner := bufio.NewScanner(strings.NewReader(string(result.Stdout)))
+    for scanner.Scan() {
+        lines = append(lines, scanner.Text())
+    }
+    return lines, true
+}
+
+// commit of the repo, if it is managed with git
+func repoGetCommit(repo string) string {
+    out, err := exec.Command("git", "-C", repo, "rev-parse", "--verify", "--quiet", "HEAD").Output()
+    if err != nil {
+        return ""
+    }
+    return strings.TrimSpace(string(out))
+}
+
+// removes a flag and its value from the arguments, eg. `--output json` or `--output=json`
+func popFlagValue(args []string, flag string) (string, []string) {
+    for i := 0; i < len(args); i++ {
+        if strings.HasPrefix(args[i], flag + "=") {
+            value := strings.TrimPrefix(args[i], flag + "=")
+            return value, slices.Delete(args, i, i + 1)
+        }
+        if args[i] == flag && i + 1 < len(args) {
+            value := args[i + 1]
+            return value, slices.Delete(args, i, i + 2)
+        }
+    }
+    return "", args
+}
+
+// removes a flag from the arguments, returns whether it was present
+func popFlag(args []string, flag string) (bool, []string) {
+    i := slices.Index(args, flag)
+    if i == -1 {
+        return false, args
+    }
+    return true, slices.Delete(args, i, i + 1)
+}
+
+// subcommands modifying the generations directory, they take the lock unless run with --dry-run
+// build has no dry run and apply builds even with --dry-run, they always take it
+// export only makes temporary directories, but genCleanup would remove them under it
+func subcommandMutates(args []string) bool {
+    if args[1] == "build" || args[1] == "apply" {
+        return true
+    }
+    if hasFlag(args, "--dry-run", 2) {
+        return false
+    }
+    switch args[1] {
+    case "switch", "delete", "align", "deletedups", "rollback", "repair", "tag", "untag", "gc", "import", "export", "migrate-store":
+        return true
+    case "storage":
+        return len(args) > 2 && args[2] == "put"
+    case "fsck":
+        return hasFlag(args, "--fix", 2)
+    }
+    return false
+}
+
+// subcommands writing a structured document with --output, switch only for its plan
+func subcommandOutputs(args []string) bool {
+    switch args[1] {
+    case "list", "show", "diff", "status", "log":
+        return true
+    case "storage":
+        return len(args) > 2 && args[2] == "get"
+    case "switch":
+        return hasFlag(args, "--dry-run", 2)
+    }
+    return false
 }
 
 func hasFlag(args []string, flag string, startLookup int) bool {
@@ -39,6 +118,43 @@ func hasFlag(args []string, flag string, startLookup int) bool {
     return false
 }
 
+// the config sets the default, flags override it
+func rollbackOnFailure(config Config, args []string, startLookup int) bool {
+    if hasFlag(args, "--no-rollback-on-failure", startLookup) {
+        return false
+    }
+    return config.RollbackOnFailure || hasFlag(args, "--rollback-on-failure", startLookup)
+}
+
+func configGetHandler(config Config, name string) (Handler, bool) {
+    for _, h := range config.Handlers {
+        if h.Name == name {
+            return h, true
+        }
+    }
+    return Handler{}, false
+}
+
+// fields of handlers taking a fixed set of values
+func configCheckHandlers(config Config) bool {
+    ok := true
+    for _, h := range config.Handlers {
+        if h.BatchSize < 0 {
+            logError("Handler " + h.Name + " has a negative batch_size")
+            ok = false
+        }
+        if h.Kind != "" && h.Kind != "lines" && h.Kind != "keyvalue" {
+            logError("Handler " + h.Name + " has unknown kind '" + h.Kind + "', expected lines or keyvalue")
+            ok = false
+        }
+        if h.OnBatchFailure != "" && h.OnBatchFailure != "stop" && h.OnBatchFailure != "bisect" {
+            logError("Handler " + h.Name + " has unknown on_batch_failure '" + h.OnBatchFailure + "', expected stop or bisect")
+            ok = false
+        }
+    }
+    return ok
+}
+
 func configInit(repo string) {
     outFile := filepath.Join(repo, configFileName)
     os.WriteFile(outFile, []byte(defaultConf), 0644)
@@ -64,17 +180,46 @@ type Handler struct {
     Sync string `yaml:"sync"`
     Upgrade string `yaml:"upgrade"`
     Multiple bool `yaml:"multiple"`
+    Query string `yaml:"query"`
+    Kind string `yaml:"kind"`
+    Separator string `yaml:"separator"`
+    Change string `yaml:"change"`
     Setup []RunWhen `yaml:"setup"`
     HookPre string `yaml:"run_before_switch"`
     HookPost string `yaml:"run_after_switch"`
+    Preset string `yaml:"preset"`
+    Extends string `yaml:"extends"`
+    Params map[string]string `yaml:"params"`
+    After []string `yaml:"after"`
+    Requires []string `yaml:"requires"`
+    Before []string `yaml:"before"`
+    LockGroup string `yaml:"lock_group"`
+    BatchSize int `yaml:"batch_size"`
+    OnBatchFailure string `yaml:"on_batch_failure"`
 }
 
 type Config struct {
     // avec une map[string]Handler, l'ordre n'est pas respecte
     Handlers []Handler `yaml:"handlers"`
+    RollbackOnFailure bool `yaml:"rollback_on_failure"`
+    Gc GcPolicy `yaml:"gc"`
+    Store string `yaml:"store"`
+    Parallel bool `yaml:"parallel"`
+    Jobs int `yaml:"jobs"`
 }
 
 func main() {
+    format, args := popFlagValue(os.Args, "--output")
+    os.Args = args
+    if format != "" {
+        if ! outputIsValidFormat(format) {
+            logUsage("eugene <subcommand> --output json|yaml")
+            os.Exit(2)
+        }
+        outputFormat = format
+        logOutput = os.Stderr
+    }
+
     repo := os.Getenv("EUGENE_REPO")
     if repo == "" {
         dotConfig := os.Getenv("XDG_CONFIG_HOME")
@@ -104,14 +249,6 @@ func main() {
         os.Setenv("EUGENE_GENS", gens)
     }
 
-    if ! fileExists(gens) {
-        os.Mkdir(gens, os.ModePerm)
-        genCreate(gens, 0, "Empty generation (automatically created)")
-        genSetCurrent(gens, 0)
-        genSetLatest(gens, 0)
-        logInfo("Initialized generations directory to " + gens)
-    }
-
     if len(os.Args) < 2 {
         fmt.Print(helpText)
         if ! manPageInstalled() {
@@ -120,6 +257,17 @@ func main() {
         os.Exit(2)
     }
 
+    if outputFormat != "" && ! subcommandOutputs(os.Args) {
+        logError("Subcommand '" + os.Args[1] + "' has no --output mode, only list, show, diff, status, log, storage get and switch --dry-run do")
+        os.Exit(2)
+    }
+
+    // does not need any configuration
+    if os.Args[1] == "presets" {
+        doPresets()
+        os.Exit(0)
+    }
+
     configFile := filepath.Join(repo, configFileName)
     if ! fileExists(configFile) {
         logError("Configuration file " + configFile + " not found")
@@ -130,10 +278,74 @@ func main() {
     var config Config
     yaml.Unmarshal(data, &config)
 
-    if os.Args[1] == "list" {
+    if ! templateApply(data, &config) || ! presetCheck(config) || ! orderHandlers(&config) || ! configCheckHandlers(config) {
+        os.Exit(1)
+    }
+    if config.Store != "" && ! slices.Contains(storeKinds, config.Store) {
+        logError("Unknown store '" + config.Store + "' in " + configFile + ", expected dir or git")
+        os.Exit(1)
+    }
+    if ! fileExists(gens) {
+        store = storeOpen(gens, config.Store)
+        os.MkdirAll(gens, os.ModePerm)
+        if ! store.Init() {
+            os.Exit(1)
+        }
+        emptyGen := genCreate(gens, 0, "Empty generation (automatically created)")
+        if emptyGen == "" || ! genCommit(0, emptyGen) || ! genSetLatest(0) || ! genSetCurrent(0) {
+            logError("Could not initialize generations directory " + gens)
+            os.Exit(1)
+        }
+        logInfo("Initialized generations directory to " + gens)
+    } else {
+        store = storeDetect(gens)
+    }
+    if config.Store != "" && config.Store != store.Kind() && os.Args[1] != "migrate-store" && os.Args[1] != "fsck" {
+        logError("The generations directory uses the " + store.Kind() + " store but the " + config.Store + " store is configured, run `eugene migrate-store`")
+        os.Exit(1)
+    }
+
+    wait, args := popFlag(os.Args, "--wait")
+    noWait, args := popFlag(args, "--no-wait")
+    jobs, args := popFlagValue(args, "--jobs")
+    os.Args = args
+    if jobs != "" {
+        n, err := strconv.Atoi(jobs)
+        if err != nil || n < 1 {
+            logUsage("eugene <subcommand> --jobs <n>")
+            os.Exit(2)
+        }
+        config.Jobs = n
+        config.Parallel = n > 1
+    }
+    if subcommandMutates(os.Args) {
+        if ! lockAcquire(gens, wait && ! noWait) {
+            os.Exit(1)
+        }
+        genCleanup(gens)
+    }
+
+    if os.Args[1] == "fsck" {
+        if doFsck(config, gens, hasFlag(os.Args, "--fix", 2)) {
+            os.Exit(0)
+        } else {
+            os.Exit(1)
+        }
+    }
+
+    if genGetCurrent() == -1 || genGetLatest() == -1 {
+        logError("The current or latest tag is missing or broken in " + gens + ", run `eugene fsck --fix`")
+        os.Exit(1)
+    }
+
+    if os.Args[1] == "list" && outputFormat != "" {
+        outputWrite(outputList(gens))
+    } else if os.Args[1] == "list" {
         showHash := hasFlag(os.Args, "--with-hash", 2)
-        allGens := genGetAll(gens)
-        currentGen := genGetCurrent(gens)
+        long := hasFlag(os.Args, "--long", 2)
+        allGens := genGetAll()
+        currentGen := genGetCurrent()
+        journal := journalLoad(gens)
         for _, num := range allGens {
             if num == currentGen {
                 fmt.Print(textGreen + "->")
@@ -144,10 +356,10 @@ func main() {
             fmt.Print(" " + strconv.Itoa(num) + " ")
 
             if showHash {
-                fmt.Print(genGetHash(gens, num) + " - ")
+                fmt.Print(genGetHash(num) + " - ")
             }
 
-            comment := genGetComment(gens, num)
+            comment := genGetComment(num)
 
             if comment != "" {
                 fmt.Print(string(comment))
@@ -155,7 +367,131 @@ func main() {
                 fmt.Print("(no comment)")
             }
 
+            if tags := genGetUserTags(num); len(tags) > 0 {
+                fmt.Print(textCyan + " [" + strings.Join(tags, ", ") + "]")
+            }
+
+            if journal != nil && num == journal.Target {
+                fmt.Print(textYellow + " (partially applied)")
+            }
+
             fmt.Print(textReset + "\n")
+
+            if long {
+                meta, ok := genGetMeta(num)
+                if ! ok {
+                    fmt.Println("     (no metadata)")
+                    continue
+                }
+                fmt.Println("     built " + meta.Built.Local().Format(time.DateTime) + " on " + meta.Host + " by " + meta.User + " with eugene " + meta.Version)
+                if last, ok := genLastSwitched(meta); ok {
+                    fmt.Println("     last switched to " + last.Local().Format(time.DateTime))
+                }
+            }
+        }
+    } else if os.Args[1] == "tag" {
+        if len(os.Args) != 4 {
+            logUsage("eugene tag <gen> <name>")
+            os.Exit(2)
+        }
+        num := genParse(gens, os.Args[2])
+        if num == -1 {
+            logError("Generation '" + os.Args[2] + "' is invalid or does not exist")
+            os.Exit(2)
+        }
+        if ! doTag(gens, num, os.Args[3]) {
+            os.Exit(1)
+        }
+    } else if os.Args[1] == "untag" {
+        if len(os.Args) != 3 {
+            logUsage("eugene untag <name>")
+            os.Exit(2)
+        }
+        if ! doUntag(os.Args[2]) {
+            os.Exit(1)
+        }
+    } else if os.Args[1] == "log" {
+        sinceArg, args := popFlagValue(os.Args, "--since")
+        handler, args := popFlagValue(args, "--handler")
+        os.Args = args
+        var since time.Time
+        if sinceArg != "" {
+            t, ok := historyParseSince(sinceArg)
+            if ! ok {
+                logUsage("eugene log [--since <date|age>] [--handler <handler>]")
+                os.Exit(2)
+            }
+            since = t
+        }
+        if outputFormat != "" {
+            if ! outputWrite(outputLog(gens, since, handler)) {
+                os.Exit(1)
+            }
+        } else {
+            doLog(gens, since, handler)
+        }
+    } else if os.Args[1] == "export" {
+        archivePath, args := popFlagValue(os.Args, "-o")
+        os.Args = args
+        if archivePath == "" || len(os.Args) < 3 {
+            logUsage("eugene export <gen...> -o <file.tar.gz>")
+            os.Exit(2)
+        }
+        var exportGens []int
+        for _, g := range os.Args[2:] {
+            num := genParse(gens, g)
+            if num == -1 {
+                logError("Generation '" + g + "' is invalid or does not exist")
+                os.Exit(2)
+            }
+            exportGens = append(exportGens, num)
+        }
+        if doExport(slices.Compact(exportGens), archivePath) {
+            os.Exit(0)
+        } else {
+            os.Exit(1)
+        }
+    } else if os.Args[1] == "import" {
+        retag, args := popFlag(os.Args, "--retag")
+        force, args := popFlag(args, "--force")
+        os.Args = args
+        if len(os.Args) != 3 {
+            logUsage("eugene import <file.tar.gz> [--retag] [--force]")
+            os.Exit(2)
+        }
+        if doImport(config, gens, os.Args[2], retag, force) {
+            os.Exit(0)
+        } else {
+            os.Exit(1)
+        }
+    } else if os.Args[1] == "migrate-store" {
+        target := config.Store
+        if len(os.Args) > 2 {
+            target = os.Args[2]
+        }
+        if ! slices.Contains(storeKinds, target) {
+            logUsage("eugene migrate-store <dir|git>")
+            os.Exit(2)
+        }
+        if doMigrateStore(storeOpen(gens, target)) {
+            os.Exit(0)
+        } else {
+            os.Exit(1)
+        }
+    } else if os.Args[1] == "tags" {
+        doTags()
+    } else if os.Args[1] == "info" {
+        if len(os.Args) < 3 {
+            logUsage("eugene info <gen>")
+            os.Exit(2)
+        }
+        num := genParse(gens, os.Args[2])
+        if num == -1 {
+            logError("Generation '" + os.Args[2] + "' is invalid or does not exist")
+            os.Exit(2)
+        }
+        if ! doInfo(num) {
+            os.Exit(1)
         }
     } else if os.Args[1] == "build" {
         if doBuild(os.Args, repo, gens, config) {
@@ -165,13 +501,21 @@ func main() {
         }
     } else if os.Args[1] == "delete" {
         if len(os.Args) > 1 {
-            deleteGens := os.Args[2:]
+            // relative references are resolved before anything is deleted
+            var deleteGens []int
+            for _, g := range os.Args[2:] {
+                num := genParse(gens, g)
+                if num == -1 {
+                    logError("Generation '" + g + "' is invalid or does not exist")
+                    os.Exit(2)
+                }
+                deleteGens = append(deleteGens, num)
+            }
             // les mettre dans l'ordre permet de ne faire qu'un seul changement du pointeur latest (si besoin)
             slices.Sort(deleteGens)
-            for _, g := range deleteGens {
-                num := genParse(gens, g)
+            for _, num := range deleteGens {
                 if ! genDelete(gens, num) {
-                    logError("Error deleting generation " + g)
+                    logError("Error deleting generation " + strconv.Itoa(num))
                     os.Exit(1)
                 }
             }
@@ -197,34 +541,17 @@ func main() {
             handler = os.Args[4]
         }
 
-        hasDiff := false
-        for _, h := range config.Handlers {
-            if handler != "" && h.Name != handler {
-                continue
-            }
-            if ! handlerShouldRun(h) {
-                continue
-            }
-            logHandler(h.Name, "Showing diff between " + os.Args[2] + " and " + os.Args[3])
-            add, remove := genDiff(gens, genA, genB, h)
-            if len(add) > 0 || len(remove) > 0 {
-                if h.Multiple {
-                    fmt.Println(textRed + "- " + strings.Join(remove, " ") + textReset)
-                    fmt.Println(textGreen + "+ " + strings.Join(add, " ") + textReset)
-                } else {
-                    for _, entry := range remove {
-                        fmt.Println(textRed + "- " + entry + textReset)
-                    }
-                    for _, entry := range add {
-                        fmt.Println(textGreen + "+ " + entry + textReset)
-                    }
-                }
-                if ! hasDiff {
-                    hasDiff = true
-                }
+        if outputFormat != "" {
+            doc := outputDiff(config, genA, genB, handler)
+            outputWrite(doc)
+            if doc.Identical {
+                os.Exit(0)
+            } else {
+                os.Exit(1)
             }
         }
 
+        hasDiff := doDiff(config, genA, genB, handler)
         if hasDiff {
             logInfo("Generations differ")
             os.Exit(1)
@@ -234,7 +561,49 @@ func main() {
         }
     } else if os.Args[1] == "switch" {
         if len(os.Args) < 3 {
-            logUsage("eugene switch <targetGen> [--dry-run]")
+            logUsage("eugene switch <targetGen> [--dry-run] [--rollback-on-failure|--no-rollback-on-failure]")
+            logUsage("eugene switch --resume [--dry-run] [--rollback-on-failure|--no-rollback-on-failure]")
+            logUsage("eugene switch --plan <file> [--dry-run] [--rollback-on-failure|--no-rollback-on-failure]")
+            logUsage("eugene switch --abandon")
+            os.Exit(2)
+        }
+
+        if os.Args[2] == "--resume" {
+            if outputFormat != "" && hasFlag(os.Args, "--dry-run", 3) {
+                journal := journalLoad(gens)
+                if journal == nil {
+                    logError("There is no interrupted switch to resume")
+                    os.Exit(1)
+                }
+                doc, ok := outputPlan(config, gens, journal.From, journal.Target, journal)
+                if ! ok || ! outputWrite(doc) {
+                    os.Exit(1)
+                }
+                os.Exit(0)
+            }
+            if doResume(config, gens, hasFlag(os.Args, "--dry-run", 3), rollbackOnFailure(config, os.Args, 3)) {
+                os.Exit(0)
+            } else {
+                os.Exit(1)
+            }
+        }
+        if os.Args[2] == "--plan" {
+            if len(os.Args) < 4 {
+                logUsage("eugene switch --plan <file> [--dry-run]")
+                os.Exit(2)
+            }
+            if doSwitchPlan(config, gens, os.Args[3], hasFlag(os.Args, "--dry-run", 4), rollbackOnFailure(config, os.Args, 4)) {
+                os.Exit(0)
+            } else {
+                os.Exit(1)
+            }
+        }
+        if os.Args[2] == "--abandon" {
+            if doAbandon(gens) {
+                os.Exit(0)
+            } else {
+                os.Exit(1)
+            }
         }
 
         targetGen := genParse(gens, os.Args[2])
@@ -242,14 +611,42 @@ func main() {
             logError("The target generation is invalid or does not exist")
             os.Exit(1)
         }
-        if targetGen == genGetCurrent(gens) {
+        if targetGen == genGetCurrent() {
             logError("Switching to the current generation makes no sense")
             os.Exit(1)
         }
 
         dryRun := hasFlag(os.Args, "--dry-run", 3)
 
-        if doSwitch(config, gens, targetGen, dryRun) {
+        if dryRun && outputFormat != "" {
+            doc, ok := outputPlan(config, gens, genGetCurrent(), targetGen, nil)
+            if ! ok || ! outputWrite(doc) {
+                os.Exit(1)
+            }
+            os.Exit(0)
+        }
+
+        if doSwitch(config, gens, targetGen, dryRun, rollbackOnFailure(config, os.Args, 3)) {
+            os.Exit(0)
+        } else {
+            os.Exit(1)
+        }
+    } else if os.Args[1] == "plan" {
+        if len(os.Args) < 3 {
+            logUsage("eugene plan <targetGen> [-o file]")
+            os.Exit(2)
+        }
+        targetGen := genParse(gens, os.Args[2])
+        if targetGen == -1 {
+            logError("The target generation is invalid or does not exist")
+            os.Exit(2)
+        }
+        planFile, _ := popFlagValue(os.Args, "-o")
+        if planFile == "" {
+            // the plan itself goes to stdout
+            logOutput = os.Stderr
+        }
+        if doPlan(config, gens, targetGen, planFile) {
             os.Exit(0)
         } else {
             os.Exit(1)
@@ -268,6 +665,11 @@ func main() {
             handler = os.Args[3]
         }
 
+        if outputFormat != "" {
+            outputWrite(outputShow(config, num, handler))
+            os.Exit(0)
+        }
+
         for _, h := range config.Handlers {
             if handler != "" && h.Name != handler {
                 continue
@@ -276,9 +678,14 @@ func main() {
                 continue
             }
             logHandler(h.Name, "Showing entries for generation " + os.Args[2])
-            entries := handlerGetEntries(gens, num, h)
+            entries := handlerGetEntries(num, h)
             if len(entries) > 0 {
-                if h.Multiple {
+                if handlerIsKeyValue(h) {
+                    for _, e := range entries {
+                        key, value := handlerSplitEntry(h, e)
+                        fmt.Println("* " + key + ": " + value)
+                    }
+                } else if h.Multiple {
                     fmt.Println("* " + strings.Join(entries, " "))
                 } else {
                     for _, e := range entries {
@@ -295,9 +702,9 @@ func main() {
     } else if os.Args[1] == "apply" {
         dryRun := hasFlag(os.Args, "--dry-run", 2)
         if doBuild(make([]string, 0), repo, gens, config) {
-            latestGen := genGetLatest(gens)
+            latestGen := genGetLatest()
             logInfo("Switching to newly built generation")
-            doSwitch(config, gens, latestGen, dryRun)
+            doSwitch(config, gens, latestGen, dryRun, rollbackOnFailure(config, os.Args, 2))
         } else {
             logInfo("Switch canceled")
         }
@@ -312,18 +719,49 @@ func main() {
             logInfo("Now aligning")
             doAlign(gens, dryRun)
         }
+    } else if os.Args[1] == "gc" {
+        // flags override the gc section of the config
+        policy := config.Gc
+        counts := map[string]*int{"--keep-last": &policy.KeepLast, "--keep-daily": &policy.KeepDaily, "--keep-weekly": &policy.KeepWeekly}
+        for flag, count := range counts {
+            value, args := popFlagValue(os.Args, flag)
+            os.Args = args
+            if value == "" {
+                continue
+            }
+            num, err := strconv.Atoi(value)
+            if err != nil || num < 0 {
+                logUsage("eugene gc [--keep-last n] [--keep-daily n] [--keep-weekly n] [--older-than age] [--dry-run]")
+                os.Exit(2)
+            }
+            *count = num
+        }
+        olderThan, args := popFlagValue(os.Args, "--older-than")
+        os.Args = args
+        if olderThan != "" {
+            policy.OlderThan = olderThan
+        }
+        dryRun := hasFlag(os.Args, "--dry-run", 2)
+        if doGc(gens, policy, dryRun) {
+            os.Exit(0)
+        } else {
+            os.Exit(1)
+        }
     } else if os.Args[1] == "rollback" {
+        dryRun, args := popFlag(os.Args, "--dry-run")
+        byNumber, args := popFlag(args, "--by-number")
+        os.Args = args
         n := 1
         if len(os.Args) >= 3 {
             num, err := strconv.Atoi(os.Args[2])
-            if err != nil {
+            if err != nil || num < 1 {
                 logError(os.Args[2] + " is an invalid number for parameter `n`")
+                os.Exit(2)
             }
             n = num
         }
-        dryRun := hasFlag(os.Args, "--dry-run", 3)
-        if doRollback(config, gens, n, dryRun) {
-            logAction("Rolled back " + os.Args[2] + " generations", dryRun)
+        if doRollback(config, gens, n, byNumber, dryRun) {
+            logAction("Rolled back " + strconv.Itoa(n) + " generations", dryRun)
         } else {
             os.Exit(1)
         }
@@ -335,6 +773,46 @@ func main() {
         } else {
             os.Exit(1)
         }        
+    } else if os.Args[1] == "status" {
+        handler := ""
+        if len(os.Args) == 3 {
+            handler = os.Args[2]
+        }
+        if outputFormat != "" {
+            doc := outputStatus(config, handler)
+            outputWrite(doc)
+            if doc.InSync {
+                os.Exit(0)
+            } else {
+                os.Exit(1)
+            }
+        }
+        if doStatus(config, handler) {
+            os.Exit(0)
+        } else {
+            os.Exit(1)
+        }
+    } else if os.Args[1] == "capture" {
+        if len(os.Args) < 3 {
+            logUsage("eugene capture <handler> [file] [--diff] [--dry-run]")
+            os.Exit(2)
+        }
+        h, ok := configGetHandler(config, os.Args[2])
+        if ! ok {
+            logError("Handler '" + os.Args[2] + "' is not defined")
+            os.Exit(2)
+        }
+        fileName := h.Name
+        if len(os.Args) > 3 && ! strings.HasPrefix(os.Args[3], "--") {
+            fileName = os.Args[3]
+        }
+        onlyUndeclared := hasFlag(os.Args, "--diff", 3)
+        dryRun := hasFlag(os.Args, "--dry-run", 3)
+        if doCapture(config, repo, h, fileName, onlyUndeclared, dryRun) {
+            os.Exit(0)
+        } else {
+            os.Exit(1)
+        }
     } else if os.Args[1] == "storage" {
         if os.Args[2] == "put" {
             if len(os.Args) < 6 {
@@ -350,14 +828,14 @@ func main() {
             key := os.Args[5]
             ok := false
             if len(os.Args) == 7 {
-                ok = genStoragePut(gens, gen, ns, key, []string{os.Args[6]})
+                ok = genStoragePut(gen, ns, key, []string{os.Args[6]})
             } else {
                 scanner := bufio.NewScanner(os.Stdin)
                 var value []string
                 for scanner.Scan() {
                     value = append(value, scanner.Text())
                 }
-                ok = genStoragePut(gens, gen, ns, key, value)
+                ok = genStoragePut(gen, ns, key, value)
             }
             if ! ok {
                 logError("Error writing value")
@@ -374,7 +852,11 @@ func main() {
             }
             ns := os.Args[4]
             key := os.Args[5]
-            for _, val := range genStorageGet(gens, gen, ns, key) {
+            if outputFormat != "" {
+                outputWrite(outputStorage(gen, ns, key))
+                os.Exit(0)
+            }
+            for _, val := range genStorageGet(gen, ns, key) {
                 fmt.Println(val)
             }
         } else {
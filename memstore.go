@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// generations kept in memory only, for tests and for trying out commands without touching the generations directory
+// temporary directories go to gens, or to the system temporary directory when gens is empty
+// the hash is the one of the directory store, computed from the files in memory
+
+type memStore struct {
+	gens        string
+	generations map[int]map[string][]byte
+	tags        map[string]int
+}
+
+func newMemStore(gens string) *memStore {
+	return &memStore{gens, make(map[int]map[string][]byte), make(map[string]int)}
+}
+
+func (s *memStore) Kind() string {
+	return "memory"
+}
+
+func (s *memStore) Init() bool {
+	return true
+}
+
+func (s *memStore) Present() bool {
+	return len(s.generations) > 0
+}
+
+func (s *memStore) Destroy() bool {
+	s.generations = make(map[int]map[string][]byte)
+	s.tags = make(map[string]int)
+	return true
+}
+
+func (s *memStore) Commit(num int, tmpDir string) bool {
+	files := make(map[string][]byte)
+	err := filepath.Walk(tmpDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err == nil {
+			rel, _ := filepath.Rel(tmpDir, path)
+			files[filepath.ToSlash(rel)] = data
+		}
+		return err
+	})
+	genDiscard(tmpDir)
+	if err != nil {
+		logError("Could not create generation " + strconv.Itoa(num) + ": " + err.Error())
+		return false
+	}
+	s.generations[num] = files
+	return true
+}
+
+func (s *memStore) List() []int {
+	var nums []int
+	for num := range s.generations {
+		nums = append(nums, num)
+	}
+	slices.Sort(nums)
+	return nums
+}
+
+func (s *memStore) Exists(num int) bool {
+	_, ok := s.generations[num]
+	return ok
+}
+
+// the lines of the files in the order genHashDir walks them, directory by directory
+func (s *memStore) Hash(num int) string {
+	files, ok := s.generations[num]
+	if ! ok {
+		return ""
+	}
+	var names []string
+	for name := range files {
+		if base := path.Base(name); base != "_comment" && base != "_meta" {
+			names = append(names, name)
+		}
+	}
+	slices.SortFunc(names, func(a string, b string) int {
+		return slices.Compare(strings.Split(a, "/"), strings.Split(b, "/"))
+	})
+	hash := sha256.New()
+	for _, name := range names {
+		scanner := bufio.NewScanner(bytes.NewReader(files[name]))
+		for scanner.Scan() {
+			hash.Write(scanner.Bytes())
+		}
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
+func (s *memStore) Delete(num int) bool {
+	if ! s.Exists(num) {
+		logError("Could not delete generation " + strconv.Itoa(num) + ": generation does not exist")
+		return false
+	}
+	delete(s.generations, num)
+	return true
+}
+
+func (s *memStore) Renumber(old int, new int) bool {
+	if ! s.Exists(old) || s.Exists(new) {
+		logError("Could not renumber generation " + strconv.Itoa(old) + " to " + strconv.Itoa(new))
+		return false
+	}
+	s.generations[new] = s.generations[old]
+	delete(s.generations, old)
+	return true
+}
+
+func (s *memStore) Extract(num int) string {
+	tmpDir, err := storeTempDir(s.gens, strconv.Itoa(num))
+	if err != nil {
+		logError("Could not extract generation " + strconv.Itoa(num) + ": " + err.Error())
+		return ""
+	}
+	for name, data := range s.generations[num] {
+		if storeWriteTempFile(tmpDir, name, data) != nil {
+			logError("Could not extract " + name + " of generation " + strconv.Itoa(num))
+			genDiscard(tmpDir)
+			return ""
+		}
+	}
+	return tmpDir
+}
+
+func (s *memStore) ReadFile(num int, name string) ([]byte, bool) {
+	data, ok := s.generations[num][name]
+	return slices.Clone(data), ok
+}
+
+func (s *memStore) WriteFile(num int, name string, data []byte) bool {
+	if ! s.Exists(num) {
+		logError("Could not write " + name + " of generation " + strconv.Itoa(num) + ": generation does not exist")
+		return false
+	}
+	s.generations[num][name] = slices.Clone(data)
+	return true
+}
+
+// directories are not kept, they vanish with their last file anyway
+func (s *memStore) RemoveFile(num int, name string) bool {
+	if _, ok := s.generations[num][name]; ! ok {
+		logError("Could not remove " + name + " of generation " + strconv.Itoa(num) + ": file does not exist")
+		return false
+	}
+	delete(s.generations[num], name)
+	return true
+}
+
+func (s *memStore) ListFiles(num int) []string {
+	var files []string
+	for name := range s.generations[num] {
+		files = append(files, name)
+	}
+	slices.Sort(files)
+	return files
+}
+
+func (s *memStore) Tag(num int, tag string) bool {
+	s.tags[tag] = num
+	return true
+}
+
+func (s *memStore) Tagged(tag string) int {
+	num, ok := s.tags[tag]
+	if ! ok {
+		return -1
+	}
+	return num
+}
+
+func (s *memStore) Untag(tag string) bool {
+	if _, ok := s.tags[tag]; ! ok {
+		logError("Could not remove tag " + tag + ": tag does not exist")
+		return false
+	}
+	delete(s.tags, tag)
+	return true
+}
+
+func (s *memStore) Tags() map[string]int {
+	tags := make(map[string]int)
+	for tag, num := range s.tags {
+		tags[tag] = num
+	}
+	return tags
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"slices"
+	"strings"
+)
+
+// handlers are ordered by their after, requires and before fields, the order of the configuration file breaks ties
+// `after: [apt]` and `requires: [apt]` run the handler once apt has added its entries, `before: [flatpak]` is the other way around
+// removals run in the reverse order, see genSwitchPlan
+// unlike after, requires skips the handler when the required one fails or does not run
+
+// the handlers each handler must come after
+func orderDependencies(handlers []Handler) (map[string][]string, bool) {
+	deps := make(map[string][]string)
+	ok := true
+	known := func(h Handler, field string, name string) bool {
+		if slices.ContainsFunc(handlers, func(other Handler) bool { return other.Name == name }) {
+			return true
+		}
+		logError("Handler " + h.Name + " has unknown handler '" + name + "' in " + field)
+		ok = false
+		return false
+	}
+	for _, h := range handlers {
+		for _, name := range h.After {
+			if known(h, "after", name) {
+				deps[h.Name] = append(deps[h.Name], name)
+			}
+		}
+		for _, name := range h.Requires {
+			if known(h, "requires", name) {
+				deps[h.Name] = append(deps[h.Name], name)
+			}
+		}
+		for _, name := range h.Before {
+			if known(h, "before", name) {
+				deps[name] = append(deps[name], h.Name)
+			}
+		}
+	}
+	return deps, ok
+}
+
+// the first handler required by h that did not succeed, "" when all did
+// statuses are the ones of parallelRun, plus "not run" for handlers whose run_if failed
+func orderUnmetRequirement(h Handler, status map[string]string) string {
+	for _, name := range h.Requires {
+		if status[name] != "done" {
+			return name
+		}
+	}
+	return ""
+}
+
+// the status of each handler once the switch is done, assuming no command fails
+// run_if is evaluated now: removals run before the handlers they require, so they can not wait for them
+func orderPredict(handlers []Handler) map[string]string {
+	status := make(map[string]string)
+	for _, h := range handlers {
+		if orderUnmetRequirement(h, status) != "" {
+			status[h.Name] = "skipped"
+		} else if ! handlerShouldRun(h) {
+			status[h.Name] = "not run"
+		} else {
+			status[h.Name] = "done"
+		}
+	}
+	return status
+}
+
+// follows the dependencies not yet placed from a handler until one comes back
+func orderFindCycle(deps map[string][]string, placed map[string]bool, start string) []string {
+	var path []string
+	current := start
+	for ! slices.Contains(path, current) {
+		path = append(path, current)
+		for _, dep := range deps[current] {
+			if ! placed[dep] {
+				current = dep
+				break
+			}
+		}
+	}
+	cycle := path[slices.Index(path, current):]
+	return append(cycle, current)
+}
+
+// sorts the handlers of the configuration, dependencies first
+func orderHandlers(config *Config) bool {
+	deps, ok := orderDependencies(config.Handlers)
+	if ! ok {
+		return false
+	}
+
+	var sorted []Handler
+	placed := make(map[string]bool)
+	remaining := slices.Clone(config.Handlers)
+	for len(remaining) > 0 {
+		next := slices.IndexFunc(remaining, func(h Handler) bool {
+			return ! slices.ContainsFunc(deps[h.Name], func(dep string) bool { return ! placed[dep] })
+		})
+		if next == -1 {
+			// each remaining handler waits for another one, there is a cycle
+			logError("Handlers depend on each other in a cycle: " + strings.Join(orderFindCycle(deps, placed, remaining[0].Name), " -> "))
+			return false
+		}
+		sorted = append(sorted, remaining[next])
+		placed[remaining[next].Name] = true
+		remaining = slices.Delete(remaining, next, next + 1)
+	}
+	config.Handlers = sorted
+	return true
+}
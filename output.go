@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// structured documents printed with --output json or --output yaml
+// bump the schema version on any incompatible change
+
+const outputSchemaVersion = 1
+
+// empty when printing text
+var outputFormat = ""
+
+type OutputGeneration struct {
+	Number           int      `json:"number" yaml:"number"`
+	Comment          string   `json:"comment" yaml:"comment"`
+	Hash             string   `json:"hash" yaml:"hash"`
+	Current          bool     `json:"current" yaml:"current"`
+	Latest           bool     `json:"latest" yaml:"latest"`
+	PartiallyApplied bool     `json:"partially_applied" yaml:"partially_applied"`
+	Tags             []string `json:"tags" yaml:"tags"`
+	Meta             *GenMeta `json:"meta,omitempty" yaml:"meta,omitempty"`
+}
+
+type OutputList struct {
+	SchemaVersion int                `json:"schema_version" yaml:"schema_version"`
+	Kind          string             `json:"kind" yaml:"kind"`
+	Generations   []OutputGeneration `json:"generations" yaml:"generations"`
+}
+
+type OutputHandlerEntries struct {
+	Name    string   `json:"name" yaml:"name"`
+	Entries []string `json:"entries" yaml:"entries"`
+}
+
+type OutputShow struct {
+	SchemaVersion int                    `json:"schema_version" yaml:"schema_version"`
+	Kind          string                 `json:"kind" yaml:"kind"`
+	Generation    int                    `json:"generation" yaml:"generation"`
+	Hash          string                 `json:"hash" yaml:"hash"`
+	Handlers      []OutputHandlerEntries `json:"handlers" yaml:"handlers"`
+}
+
+type OutputHandlerDiff struct {
+	Name   string   `json:"name" yaml:"name"`
+	Add    []string `json:"add" yaml:"add"`
+	Remove []string `json:"remove" yaml:"remove"`
+	Change []Change `json:"change" yaml:"change"`
+}
+
+type OutputDiff struct {
+	SchemaVersion int                 `json:"schema_version" yaml:"schema_version"`
+	Kind          string              `json:"kind" yaml:"kind"`
+	From          int                 `json:"from" yaml:"from"`
+	FromHash      string              `json:"from_hash" yaml:"from_hash"`
+	To            int                 `json:"to" yaml:"to"`
+	ToHash        string              `json:"to_hash" yaml:"to_hash"`
+	Identical     bool                `json:"identical" yaml:"identical"`
+	Handlers      []OutputHandlerDiff `json:"handlers" yaml:"handlers"`
+}
+
+type OutputStorage struct {
+	SchemaVersion int      `json:"schema_version" yaml:"schema_version"`
+	Kind          string   `json:"kind" yaml:"kind"`
+	Generation    int      `json:"generation" yaml:"generation"`
+	Namespace     string   `json:"namespace" yaml:"namespace"`
+	Key           string   `json:"key" yaml:"key"`
+	Value         []string `json:"value" yaml:"value"`
+}
+
+type OutputPlan struct {
+	SchemaVersion int          `json:"schema_version" yaml:"schema_version"`
+	Kind          string       `json:"kind" yaml:"kind"`
+	From          int          `json:"from" yaml:"from"`
+	FromHash      string       `json:"from_hash" yaml:"from_hash"`
+	Target        int          `json:"target" yaml:"target"`
+	TargetHash    string       `json:"target_hash" yaml:"target_hash"`
+	Steps         []SwitchStep `json:"steps" yaml:"steps"`
+}
+
+// status is "in_sync", "drifted", "query_failed", or "no_query" for handlers without query command
+type OutputHandlerStatus struct {
+	Name      string   `json:"name" yaml:"name"`
+	Status    string   `json:"status" yaml:"status"`
+	Missing   []string `json:"missing" yaml:"missing"`
+	Unmanaged []string `json:"unmanaged" yaml:"unmanaged"`
+}
+
+type OutputStatus struct {
+	SchemaVersion int                   `json:"schema_version" yaml:"schema_version"`
+	Kind          string                `json:"kind" yaml:"kind"`
+	Generation    int                   `json:"generation" yaml:"generation"`
+	Hash          string                `json:"hash" yaml:"hash"`
+	InSync        bool                  `json:"in_sync" yaml:"in_sync"`
+	Handlers      []OutputHandlerStatus `json:"handlers" yaml:"handlers"`
+}
+
+type OutputLog struct {
+	SchemaVersion int            `json:"schema_version" yaml:"schema_version"`
+	Kind          string         `json:"kind" yaml:"kind"`
+	Events        []HistoryEvent `json:"events" yaml:"events"`
+}
+
+func outputIsValidFormat(format string) bool {
+	return format == "json" || format == "yaml"
+}
+
+func outputWrite(doc interface{}) bool {
+	var data []byte
+	var err error
+	if outputFormat == "yaml" {
+		data, err = yaml.Marshal(doc)
+	} else {
+		data, err = json.MarshalIndent(doc, "", "  ")
+		data = append(data, '\n')
+	}
+	if err != nil {
+		logError("Could not encode output: " + err.Error())
+		return false
+	}
+	os.Stdout.Write(data)
+	return true
+}
+
+func outputList(gens string) OutputList {
+	doc := OutputList{outputSchemaVersion, "list", []OutputGeneration{}}
+	currentGen := genGetCurrent()
+	latestGen := genGetLatest()
+	journal := journalLoad(gens)
+	for _, num := range genGetAll() {
+		g := OutputGeneration{
+			Number:           num,
+			Comment:          genGetComment(num),
+			Hash:             genGetHash(num),
+			Current:          num == currentGen,
+			Latest:           num == latestGen,
+			PartiallyApplied: journal != nil && num == journal.Target,
+			Tags:             append([]string{}, genGetUserTags(num)...),
+		}
+		if meta, ok := genGetMeta(num); ok {
+			g.Meta = &meta
+		}
+		doc.Generations = append(doc.Generations, g)
+	}
+	return doc
+}
+
+func outputShow(config Config, num int, handler string) OutputShow {
+	doc := OutputShow{outputSchemaVersion, "show", num, genGetHash(num), []OutputHandlerEntries{}}
+	for _, h := range config.Handlers {
+		if handler != "" && h.Name != handler {
+			continue
+		}
+		if ! handlerShouldRun(h) {
+			continue
+		}
+		entries := handlerGetEntries(num, h)
+		if entries == nil {
+			entries = []string{}
+		}
+		doc.Handlers = append(doc.Handlers, OutputHandlerEntries{h.Name, entries})
+	}
+	return doc
+}
+
+func outputDiff(config Config, a int, b int, handler string) OutputDiff {
+	doc := OutputDiff{outputSchemaVersion, "diff", a, genGetHash(a), b, genGetHash(b), true, []OutputHandlerDiff{}}
+	for _, h := range config.Handlers {
+		if handler != "" && h.Name != handler {
+			continue
+		}
+		if ! handlerShouldRun(h) {
+			continue
+		}
+		d := OutputHandlerDiff{h.Name, []string{}, []string{}, []Change{}}
+		var add, remove []string
+		var change []Change
+		if handlerIsKeyValue(h) {
+			add, change, remove = genDiffKeyValue(a, b, h)
+		} else {
+			add, remove = genDiff(a, b, h)
+		}
+		d.Add = append(d.Add, add...)
+		d.Remove = append(d.Remove, remove...)
+		d.Change = append(d.Change, change...)
+		if len(add) > 0 || len(remove) > 0 || len(change) > 0 {
+			doc.Identical = false
+		}
+		doc.Handlers = append(doc.Handlers, d)
+	}
+	return doc
+}
+
+func outputStorage(num int, namespace string, key string) OutputStorage {
+	value := genStorageGet(num, namespace, key)
+	if value == nil {
+		value = []string{}
+	}
+	return OutputStorage{outputSchemaVersion, "storage", num, namespace, key, value}
+}
+
+// like doStatus, handlers without query command are listed but not compared
+func outputStatus(config Config, handler string) OutputStatus {
+	num := genGetCurrent()
+	doc := OutputStatus{outputSchemaVersion, "status", num, genGetHash(num), true, []OutputHandlerStatus{}}
+	for _, h := range config.Handlers {
+		if handler != "" && h.Name != handler {
+			continue
+		}
+		if ! handlerShouldRun(h) {
+			continue
+		}
+		s := OutputHandlerStatus{h.Name, "no_query", []string{}, []string{}}
+		if h.Query != "" {
+			missing, extras, ok := handlerDrift(num, h)
+			s.Missing = append(s.Missing, missing...)
+			s.Unmanaged = append(s.Unmanaged, extras...)
+			switch {
+			case ! ok:
+				s.Status = "query_failed"
+			case len(missing) > 0 || len(extras) > 0:
+				s.Status = "drifted"
+			default:
+				s.Status = "in_sync"
+			}
+			if s.Status != "in_sync" {
+				doc.InSync = false
+			}
+		}
+		doc.Handlers = append(doc.Handlers, s)
+	}
+	return doc
+}
+
+// steps already recorded in the journal are left out
+func outputPlan(config Config, gens string, from int, target int, journal *Journal) (OutputPlan, bool) {
+	doc := OutputPlan{outputSchemaVersion, "plan", from, genGetHash(from), target, genGetHash(target), []SwitchStep{}}
+	steps, ok := genSwitchPlan(config, gens, from, target, journal)
+	doc.Steps = append(doc.Steps, steps...)
+	return doc, ok
+}
+
+func outputLog(gens string, since time.Time, handler string) OutputLog {
+	return OutputLog{outputSchemaVersion, "log", historyFilter(historyRead(gens), since, handler)}
+}
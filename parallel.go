@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// with `parallel: true` or --jobs, the handlers of a switch run concurrently
+// a handler still waits for the handlers it depends on (removals wait for the handlers depending on it instead),
+// and handlers of the same lock_group never run at the same time, eg. two handlers using apt
+// the output of each handler is buffered and printed at once when it is done, prefixed with its name
+
+type parallelDone struct {
+	h      Handler
+	status string
+	out    *bytes.Buffer
+}
+
+func parallelJobs(config Config) int {
+	if config.Jobs > 0 {
+		return config.Jobs
+	}
+	return runtime.NumCPU()
+}
+
+func parallelFlush(name string, out *bytes.Buffer) {
+	scanner := bufio.NewScanner(out)
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, textCyan + name + " |" + textReset + " " + scanner.Text())
+	}
+	if len(lines) > 0 {
+		fmt.Fprintln(logOutput, strings.Join(lines, "\n"))
+	}
+}
+
+// "ready", "wait", or "skipped" when a handler it waits for failed, or one it requires did not run
+func parallelState(h Handler, waitsFor map[string][]string, status map[string]string) string {
+	state := "ready"
+	for _, name := range waitsFor[h.Name] {
+		switch status[name] {
+		case "done":
+		case "not run":
+			if slices.Contains(h.Requires, name) {
+				return "skipped"
+			}
+		case "failed", "skipped":
+			return "skipped"
+		default:
+			state = "wait"
+		}
+	}
+	return state
+}
+
+// runs every handler once the handlers it waits for are done, returns the status of each handler
+// run returns "done", "failed" or "not run"
+func parallelRun(handlers []Handler, waitsFor map[string][]string, jobs int, run func(h Handler, out *bytes.Buffer) string) map[string]string {
+	status := make(map[string]string)
+	finished := make(chan parallelDone)
+	lockGroups := make(map[string]bool)
+	pending := slices.Clone(handlers)
+	running := 0
+	for {
+		for i := 0; i < len(pending) && running < jobs; {
+			h := pending[i]
+			state := parallelState(h, waitsFor, status)
+			if state == "skipped" {
+				status[h.Name] = "skipped"
+				pending = slices.Delete(pending, i, i + 1)
+				// a handler waiting for this one may already have been looked at
+				i = 0
+				continue
+			}
+			if state == "wait" || (h.LockGroup != "" && lockGroups[h.LockGroup]) {
+				i++
+				continue
+			}
+			if h.LockGroup != "" {
+				lockGroups[h.LockGroup] = true
+			}
+			status[h.Name] = "running"
+			running++
+			pending = slices.Delete(pending, i, i + 1)
+			go func(h Handler) {
+				out := new(bytes.Buffer)
+				finished <- parallelDone{h, run(h, out), out}
+			}(h)
+		}
+		if running == 0 {
+			break
+		}
+		done := <-finished
+		running--
+		if done.h.LockGroup != "" {
+			lockGroups[done.h.LockGroup] = false
+		}
+		status[done.h.Name] = done.status
+		parallelFlush(done.h.Name, done.out)
+	}
+	return status
+}
+
+func parallelStatus(ok bool) string {
+	if ok {
+		return "done"
+	}
+	return "failed"
+}
+
+func parallelSummary(handlers []Handler, status map[string]string) {
+	logInfo("Summary of the switch:")
+	for _, h := range handlers {
+		switch status[h.Name] {
+		case "done":
+			logHandler(h.Name, textGreen + "succeeded")
+		case "failed":
+			logHandler(h.Name, textRed + "failed")
+		case "not run":
+			logHandler(h.Name, "not run, its run_if command failed")
+		case "skipped":
+			logHandler(h.Name, textYellow + "skipped, it was waiting for a handler that failed or requires one that did not run")
+		default:
+			logHandler(h.Name, textYellow + "not run, the switch stopped before")
+		}
+	}
+}
+
+func parallelSwitch(config Config, gens string, fromGen int, targetGen int, journal *Journal, dryRun bool) bool {
+	jobs := parallelJobs(config)
+	deps, _ := orderDependencies(config.Handlers)
+	dependents := make(map[string][]string)
+	for name, names := range deps {
+		for _, dep := range names {
+			dependents[dep] = append(dependents[dep], name)
+		}
+	}
+
+	// a handler is done once both phases are
+	// the removals run before the handlers they require, which handlers run is decided beforehand
+	predicted := orderPredict(config.Handlers)
+	logInfo("Running up to " + strconv.Itoa(jobs) + " handlers at once, their commands get no standard input")
+	status := parallelRun(config.Handlers, dependents, jobs, func(h Handler, out *bytes.Buffer) string {
+		if predicted[h.Name] != "done" {
+			return "not run"
+		}
+		return parallelStatus(genSwitchHandler(h, gens, fromGen, targetGen, journal, dryRun, "removals", out))
+	})
+	ok := ! slices.ContainsFunc(config.Handlers, func(h Handler) bool { return status[h.Name] == "failed" || status[h.Name] == "skipped" })
+	if ok {
+		status = parallelRun(config.Handlers, deps, jobs, func(h Handler, out *bytes.Buffer) string {
+			if ! handlerShouldRunTo(out, h) {
+				return "not run"
+			}
+			return parallelStatus(genSwitchHandler(h, gens, fromGen, targetGen, journal, dryRun, genSwitchSecondPhase(predicted, h), out))
+		})
+		ok = ! slices.ContainsFunc(config.Handlers, func(h Handler) bool { return status[h.Name] == "failed" })
+	} else {
+		for name, s := range status {
+			if s == "done" || s == "not run" {
+				delete(status, name)
+			}
+		}
+	}
+	parallelSummary(config.Handlers, status)
+	return ok
+}
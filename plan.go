@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"gopkg.in/yaml.v2"
+)
+
+// a plan file holds every command of a switch, with the hashes of both generations
+// `eugene switch --plan` runs exactly these commands, as long as the generations did not change
+
+func planWrite(path string, plan OutputPlan) bool {
+	var data []byte
+	var err error
+	ext := filepath.Ext(path)
+	if ext == ".yml" || ext == ".yaml" {
+		data, err = yaml.Marshal(plan)
+	} else {
+		data, err = json.MarshalIndent(plan, "", "  ")
+		data = append(data, '\n')
+	}
+	if err != nil {
+		logError("Could not encode plan: " + err.Error())
+		return false
+	}
+	err = os.WriteFile(path, data, 0644)
+	if err != nil {
+		logError("Could not write plan: " + err.Error())
+		return false
+	}
+	return true
+}
+
+func planRead(path string) (OutputPlan, bool) {
+	var plan OutputPlan
+	data, err := os.ReadFile(path)
+	if err != nil {
+		logError("Could not read plan: " + err.Error())
+		return plan, false
+	}
+	// json is valid yaml
+	err = yaml.Unmarshal(data, &plan)
+	if err != nil {
+		logError("Could not parse plan " + path + ": " + err.Error())
+		return plan, false
+	}
+	if plan.Kind != "plan" {
+		logError(path + " is not a plan file")
+		return plan, false
+	}
+	if plan.SchemaVersion != outputSchemaVersion {
+		logError("Plan " + path + " uses schema version " + strconv.Itoa(plan.SchemaVersion) + ", this eugene supports version " + strconv.Itoa(outputSchemaVersion))
+		return plan, false
+	}
+	return plan, true
+}
+
+// the plan only applies to the generations it was made for
+func planCheck(plan OutputPlan) bool {
+	currentGen := genGetCurrent()
+	if plan.From != currentGen {
+		logError("The plan starts from generation " + strconv.Itoa(plan.From) + " but the current generation is " + strconv.Itoa(currentGen))
+		return false
+	}
+	if genGetHash(plan.From) != plan.FromHash {
+		logError("Generation " + strconv.Itoa(plan.From) + " changed since the plan was made")
+		return false
+	}
+	if ! genExists(plan.Target) {
+		logError("The target generation " + strconv.Itoa(plan.Target) + " of the plan does not exist")
+		return false
+	}
+	if genGetHash(plan.Target) != plan.TargetHash {
+		logError("Generation " + strconv.Itoa(plan.Target) + " changed since the plan was made")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// built-in handlers for common package managers, used with `preset: <name>`
+// the fields set on the handler override the ones of the preset, the name defaults to the preset's one
+
+var handlerPresets = map[string]Handler{
+	"apt": {
+		RunIf:    "command -v apt-get >/dev/null",
+		Add:      "sudo apt-get install -y %s",
+		Remove:   "sudo apt-get purge -y --autoremove %s",
+		Sync:     "sudo apt-get update",
+		Upgrade:  "sudo apt-get update && sudo apt-get full-upgrade -y",
+		Multiple: true,
+		Query:    "apt-mark showmanual",
+	},
+	"dnf": {
+		RunIf:    "command -v dnf >/dev/null",
+		Add:      "sudo dnf install -y %s",
+		Remove:   "sudo dnf remove -y %s",
+		Sync:     "sudo dnf makecache",
+		Upgrade:  "sudo dnf upgrade -y",
+		Multiple: true,
+		Query:    "dnf repoquery --userinstalled --queryformat '%{name}\\n'",
+	},
+	"pacman": {
+		RunIf:    "command -v pacman >/dev/null",
+		Add:      "sudo pacman -S --needed --noconfirm %s",
+		Remove:   "sudo pacman -Rns --noconfirm %s",
+		Upgrade:  "sudo pacman -Syu --noconfirm",
+		Multiple: true,
+		Query:    "pacman -Qqe",
+	},
+	"zypper": {
+		RunIf:    "command -v zypper >/dev/null",
+		Add:      "sudo zypper --non-interactive install %s",
+		Remove:   "sudo zypper --non-interactive remove --clean-deps %s",
+		Sync:     "sudo zypper --non-interactive refresh",
+		Upgrade:  "sudo zypper --non-interactive update",
+		Multiple: true,
+	},
+	"flatpak": {
+		RunIf:    "command -v flatpak >/dev/null",
+		Add:      "flatpak install --noninteractive flathub %s",
+		Remove:   "flatpak uninstall --noninteractive %s",
+		Upgrade:  "flatpak update --noninteractive",
+		Multiple: true,
+		Query:    "flatpak list --app --columns=application",
+	},
+	"snap": {
+		RunIf:    "command -v snap >/dev/null",
+		Add:      "sudo snap install %s",
+		Remove:   "sudo snap remove %s",
+		Upgrade:  "sudo snap refresh",
+		Multiple: true,
+		Query:    "snap list | awk 'NR > 1 { print $1 }'",
+	},
+	"brew": {
+		RunIf:    "command -v brew >/dev/null",
+		Add:      "brew install %s",
+		Remove:   "brew uninstall %s",
+		Sync:     "brew update",
+		Upgrade:  "brew upgrade",
+		Multiple: true,
+		Query:    "brew leaves --installed-on-request",
+	},
+	// pipx uninstall takes a single package
+	"pipx": {
+		RunIf:   "command -v pipx >/dev/null",
+		Add:     "pipx install %s",
+		Remove:  "pipx uninstall %s",
+		Upgrade: "pipx upgrade-all",
+		Query:   "pipx list --short | cut -d ' ' -f 1",
+	},
+	"npm": {
+		RunIf:    "command -v npm >/dev/null",
+		Add:      "npm install -g %s",
+		Remove:   "npm uninstall -g %s",
+		Upgrade:  "npm update -g",
+		Multiple: true,
+		Query:    "npm ls -g --depth=0 --parseable | sed '1d; s|.*/node_modules/||'",
+	},
+	"cargo": {
+		RunIf:    "command -v cargo >/dev/null",
+		Add:      "cargo install %s",
+		Remove:   "cargo uninstall %s",
+		Multiple: true,
+		Query:    "cargo install --list | grep -v '^ ' | cut -d ' ' -f 1",
+	},
+	// entries such as `org.gnome.desktop.interface gtk-theme='Adwaita-dark'`
+	"gsettings": {
+		RunIf:  "command -v gsettings >/dev/null",
+		Kind:   "keyvalue",
+		Add:    "gsettings set %k %v",
+		Change: "gsettings set %k %v",
+		Remove: "gsettings reset %k",
+	},
+}
+
+func presetNames() []string {
+	var names []string
+	for name := range handlerPresets {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// the handler as the preset defines it, before the fields of the configuration file are applied
+func presetHandler(name string) (Handler, bool) {
+	h, ok := handlerPresets[name]
+	if ! ok {
+		return Handler{}, false
+	}
+	h.Name = name
+	h.Preset = name
+	return h, true
+}
+
+// the preset is applied first, the fields of the configuration file are then decoded over it
+func (h *Handler) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var preset struct {
+		Preset string `yaml:"preset"`
+	}
+	if err := unmarshal(&preset); err != nil {
+		return err
+	}
+	*h = Handler{Preset: preset.Preset}
+	if p, ok := presetHandler(preset.Preset); ok {
+		*h = p
+	}
+	// without its methods, so that decoding does not come back here
+	type plainHandler Handler
+	return unmarshal((*plainHandler)(h))
+}
+
+// handlers of the configuration using a preset that does not exist
+func presetCheck(config Config) bool {
+	ok := true
+	for _, h := range config.Handlers {
+		if _, found := handlerPresets[h.Preset]; h.Preset != "" && ! found {
+			logError("Handler " + h.Name + " uses unknown preset '" + h.Preset + "', available presets: " + strings.Join(presetNames(), ", "))
+			ok = false
+		}
+	}
+	return ok
+}
+
+func presetPrintField(name string, value string) {
+	if value != "" {
+		fmt.Println("  " + name + ": " + value)
+	}
+}
+
+func doPresets() {
+	for i, name := range presetNames() {
+		h, _ := presetHandler(name)
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Println(textCyan + name + textReset)
+		presetPrintField("run_if", h.RunIf)
+		presetPrintField("kind", h.Kind)
+		presetPrintField("add", h.Add)
+		presetPrintField("change", h.Change)
+		presetPrintField("remove", h.Remove)
+		presetPrintField("sync", h.Sync)
+		presetPrintField("upgrade", h.Upgrade)
+		presetPrintField("query", h.Query)
+		if h.Multiple {
+			presetPrintField("multiple", "true")
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// generation references, on top of numbers and tags:
+//   <ref>~n, <ref>^   n generations (1 with ^) before <ref>, in number order
+//   @{date}           the generation that was current at that date
+//   /regex/           the generation whose comment matches
+//   hash prefix       the generation whose hash starts with it (at least 4 characters, not only digits)
+// errors are logged, -1 is returned for invalid or ambiguous references
+
+const refMinHashPrefix = 4
+
+var refHashPattern = regexp.MustCompile(`^[0-9a-f]+$`)
+
+func refCandidates(nums []int) string {
+	var candidates []string
+	for _, num := range nums {
+		candidates = append(candidates, strconv.Itoa(num) + " (" + genGetComment(num) + ")")
+	}
+	return strings.Join(candidates, ", ")
+}
+
+// a single generation or an error listing the candidates
+func refUnique(ref string, matches []int) int {
+	if len(matches) == 0 {
+		return -1
+	}
+	if len(matches) > 1 {
+		logError("Reference '" + ref + "' is ambiguous, candidates: " + refCandidates(matches))
+		return -1
+	}
+	return matches[0]
+}
+
+func refByComment(ref string) int {
+	re, err := regexp.Compile(ref[1:len(ref) - 1])
+	if err != nil {
+		logError("Invalid regex in reference '" + ref + "': " + err.Error())
+		return -1
+	}
+	var matches []int
+	for _, num := range genGetAll() {
+		if re.MatchString(genGetComment(num)) {
+			matches = append(matches, num)
+		}
+	}
+	return refUnique(ref, matches)
+}
+
+// a date alone stands for the end of that day
+func refParseDate(date string) (time.Time, bool) {
+	for _, layout := range []string{time.DateTime, "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02T15:04"} {
+		t, err := time.ParseInLocation(layout, date, time.Local)
+		if err == nil {
+			return t, true
+		}
+	}
+	t, err := time.ParseInLocation(time.DateOnly, date, time.Local)
+	if err == nil {
+		return t.AddDate(0, 0, 1).Add(-time.Second), true
+	}
+	return time.Time{}, false
+}
+
+// the last generation switched to before the date, from the switch history
+func refByDate(ref string) int {
+	at, ok := refParseDate(ref[2:len(ref) - 1])
+	if ! ok {
+		logError("Invalid date in reference '" + ref + "', expected eg. 2026-09-01 or 2026-09-01 18:30")
+		return -1
+	}
+	found := -1
+	var foundTime time.Time
+	for _, num := range genGetAll() {
+		meta, _ := genGetMeta(num)
+		for _, switched := range meta.Switched {
+			if ! switched.After(at) && ! switched.Before(foundTime) {
+				found = num
+				foundTime = switched
+			}
+		}
+	}
+	if found == -1 {
+		logError("No generation was current at " + ref[2:len(ref) - 1])
+	}
+	return found
+}
+
+func refByHash(ref string) int {
+	var matches []int
+	for _, num := range genGetAll() {
+		if strings.HasPrefix(genGetHash(num), ref) {
+			matches = append(matches, num)
+		}
+	}
+	return refUnique(ref, matches)
+}
+
+// n generations before num, gaps in numbers are skipped
+func refAncestor(num int, n int) int {
+	allGens := genGetAll()
+	slices.Sort(allGens)
+	i := slices.Index(allGens, num)
+	if i - n < 0 {
+		logError("Generation " + strconv.Itoa(num) + " has only " + strconv.Itoa(i) + " generations before it")
+		return -1
+	}
+	return allGens[i - n]
+}
+
+// parses the trailing ~n and ^ of a reference, returns the total count
+func refParseAncestry(ops string) (int, bool) {
+	count := 0
+	for ops != "" {
+		op := ops[0]
+		ops = ops[1:]
+		if op == '^' {
+			count++
+			continue
+		}
+		if op != '~' {
+			return 0, false
+		}
+		digits := len(ops) - len(strings.TrimLeft(ops, "0123456789"))
+		if digits == 0 {
+			count++
+			continue
+		}
+		n, _ := strconv.Atoi(ops[:digits])
+		count += n
+		ops = ops[digits:]
+	}
+	return count, true
+}
+
+func refResolve(gens string, ref string) int {
+	// split the base from the ancestry operators, the base may contain them itself
+	split := strings.IndexAny(ref, "~^")
+	if strings.HasPrefix(ref, "/") {
+		split = strings.LastIndex(ref, "/") + 1
+	} else if strings.HasPrefix(ref, "@{") {
+		split = strings.Index(ref, "}") + 1
+	}
+	if split > 0 && split < len(ref) {
+		n, ok := refParseAncestry(ref[split:])
+		if ! ok {
+			return -1
+		}
+		base := refResolve(gens, ref[:split])
+		if base == -1 {
+			return -1
+		}
+		return refAncestor(base, n)
+	}
+
+	// digits alone are a generation number, never a hash prefix, so that `delete 1234` can not delete another generation
+	if num, err := strconv.Atoi(ref); err == nil {
+		if ! genExists(num) {
+			return -1
+		}
+		return num
+	}
+	if len(ref) > 2 && strings.HasPrefix(ref, "/") && strings.HasSuffix(ref, "/") {
+		return refByComment(ref)
+	}
+	if len(ref) > 3 && strings.HasPrefix(ref, "@{") && strings.HasSuffix(ref, "}") {
+		return refByDate(ref)
+	}
+	// current, latest or any other tag
+	if num := genGetTagged(ref); num != -1 && genExists(num) {
+		return num
+	}
+	if len(ref) >= refMinHashPrefix && refHashPattern.MatchString(ref) {
+		return refByHash(ref)
+	}
+	return -1
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// where the generations and their tags are kept, the gen* functions of generation.go go through it
+// the entries of handlers, storage, _comment and _meta are all files of a generation,
+// named by their slash separated path relative to the generation
+// implementations: dirstore.go (default), gitstore.go (`store: git`) and memstore.go
+type GenerationStore interface {
+	Kind() string
+	// creates the store in the generations directory
+	Init() bool
+	// whether anything of the store is in the generations directory, complete or not
+	Present() bool
+	// removes the whole store from the generations directory
+	Destroy() bool
+
+	// takes a generation built in a temporary directory by genCreate, the directory is consumed
+	Commit(num int, tmpDir string) bool
+	List() []int
+	Exists(num int) bool
+	Hash(num int) string
+	Delete(num int) bool
+	Renumber(old int, new int) bool
+	// copies a generation into a temporary directory, as genCreate makes them
+	Extract(num int) string
+
+	ReadFile(num int, name string) ([]byte, bool)
+	WriteFile(num int, name string, data []byte) bool
+	// the directory holding the file goes with it once empty
+	RemoveFile(num int, name string) bool
+	ListFiles(num int) []string
+
+	// the tag is replaced atomically, it never goes missing
+	Tag(num int, tag string) bool
+	// -1 if the tag is missing or broken
+	Tagged(tag string) int
+	Untag(tag string) bool
+	Tags() map[string]int
+}
+
+// what only some stores can do, checked with a type assertion on the store
+
+// tells whether a file is the same in two generations without reading it
+type sameFileStore interface {
+	sameFile(a int, b int, name string) bool
+}
+
+// dates the generations without metadata
+type modTimeStore interface {
+	modTime(num int) time.Time
+}
+
+// keeps storage namespaces once their last key is removed
+type namespaceStore interface {
+	emptyNamespaces(num int) []string
+	removeNamespace(num int, namespace string) bool
+}
+
+// checks what the store keeps besides the generations, see doFsck
+// returns the number of problems remaining
+type checkedStore interface {
+	check(fix bool) int
+}
+
+// the store of the generations directory, set by main once the configuration is loaded
+var store GenerationStore
+
+var storeKinds = []string{"dir", "git"}
+
+func storeOpen(gens string, kind string) GenerationStore {
+	switch kind {
+	case "git":
+		return &gitStore{gens}
+	case "memory":
+		return newMemStore(gens)
+	}
+	return &dirStore{gens}
+}
+
+// a git store is only used once complete, the current tag is the last thing a migration writes
+func storeDetect(gens string) GenerationStore {
+	if git := (&gitStore{gens}); git.complete() {
+		return git
+	}
+	return &dirStore{gens}
+}
+
+// generation directories and tag symlinks, what the directory store keeps in the generations directory
+func storeDirFiles(gens string) []string {
+	var files []string
+	generationRegex, _ := regexp.Compile("^[0-9]+$")
+	entries, _ := os.ReadDir(gens)
+	for _, e := range entries {
+		isTag := e.Type() & os.ModeSymlink != 0 && ! strings.HasPrefix(e.Name(), ".")
+		if isTag || (e.IsDir() && generationRegex.MatchString(e.Name())) {
+			files = append(files, e.Name())
+		}
+	}
+	return files
+}
+
+// a temporary directory of the generations directory, for a generation being built or extracted
+func storeTempDir(gens string, name string) (string, error) {
+	return os.MkdirTemp(gens, tmpPrefix + name + "-")
+}
+
+func storeWriteTempFile(tmpDir string, name string, data []byte) error {
+	path := filepath.Join(tmpDir, filepath.FromSlash(name))
+	os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	return os.WriteFile(path, data, 0644)
+}
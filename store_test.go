@@ -0,0 +1,138 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// commits a generation made of the files, as genCreate would build it
+func testCommit(t *testing.T, s GenerationStore, gens string, num int, files map[string]string) {
+	t.Helper()
+	tmpDir, err := storeTempDir(gens, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := storeWriteTempFile(tmpDir, name, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ! s.Commit(num, tmpDir) {
+		t.Fatalf("commit of generation %d failed", num)
+	}
+}
+
+// temporary directories left in the generations directory
+func testLeftovers(t *testing.T, gens string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(gens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var leftovers []string
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), tmpPrefix) {
+			leftovers = append(leftovers, e.Name())
+		}
+	}
+	return leftovers
+}
+
+func TestStoreGenerations(t *testing.T) {
+	for _, kind := range append(storeKinds, "memory") {
+		t.Run(kind, func(t *testing.T) {
+			gens := t.TempDir()
+			s := storeOpen(gens, kind)
+			if ! s.Init() {
+				t.Fatal("init failed")
+			}
+			testCommit(t, s, gens, 0, map[string]string{"_comment": "empty\n"})
+			testCommit(t, s, gens, 1, map[string]string{"pkgs": "a\nb\n", "storage/ns/key": "value\n"})
+
+			if got := s.List(); ! slices.Equal(got, []int{0, 1}) {
+				t.Fatalf("List() = %v, want [0 1]", got)
+			}
+			if ! s.Exists(1) || s.Exists(2) {
+				t.Fatal("Exists does not match the committed generations")
+			}
+			if data, ok := s.ReadFile(1, "pkgs"); ! ok || string(data) != "a\nb\n" {
+				t.Fatalf("ReadFile(1, pkgs) = %q, %v", data, ok)
+			}
+			if _, ok := s.ReadFile(1, "missing"); ok {
+				t.Fatal("ReadFile of a missing file succeeded")
+			}
+
+			if ! s.WriteFile(1, "storage/ns/other", []byte("x\n")) {
+				t.Fatal("WriteFile failed")
+			}
+			if got := s.ListFiles(1); ! slices.Equal(got, []string{"pkgs", "storage/ns/key", "storage/ns/other"}) {
+				t.Fatalf("ListFiles(1) = %v", got)
+			}
+			if ! s.RemoveFile(1, "storage/ns/other") || slices.Contains(s.ListFiles(1), "storage/ns/other") {
+				t.Fatal("RemoveFile did not remove the file")
+			}
+
+			hash := s.Hash(1)
+			if hash == "" || hash == s.Hash(0) {
+				t.Fatalf("Hash(1) = %q, Hash(0) = %q", hash, s.Hash(0))
+			}
+
+			if ! s.Tag(1, "stable") || s.Tagged("stable") != 1 {
+				t.Fatal("Tag did not tag generation 1")
+			}
+			if ! s.Tag(0, "stable") || s.Tagged("stable") != 0 {
+				t.Fatal("Tag did not move the tag to generation 0")
+			}
+			if tags := s.Tags(); len(tags) != 1 || tags["stable"] != 0 {
+				t.Fatalf("Tags() = %v", tags)
+			}
+			if ! s.Untag("stable") || s.Tagged("stable") != -1 {
+				t.Fatal("Untag did not remove the tag")
+			}
+
+			if ! s.Renumber(1, 3) || s.Exists(1) || ! s.Exists(3) {
+				t.Fatal("Renumber did not move generation 1 to 3")
+			}
+			if s.Hash(3) != hash {
+				t.Fatal("Renumber changed the hash of the generation")
+			}
+			if ! s.Delete(3) || s.Exists(3) {
+				t.Fatal("Delete did not delete generation 3")
+			}
+			if leftovers := testLeftovers(t, gens); len(leftovers) > 0 {
+				t.Fatalf("temporary directories left: %v", leftovers)
+			}
+		})
+	}
+}
+
+func TestMemStoreHash(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+	}{
+		{"empty", map[string]string{}},
+		{"comment and meta ignored", map[string]string{"_comment": "a comment\n", "_meta": "host: a\n", "pkgs": "a\n"}},
+		{"several handlers", map[string]string{"apt": "vim\ngit\n", "flatpak": "org.gnome.Maps\n"}},
+		{"no trailing newline", map[string]string{"pkgs": "a\nb"}},
+		// genHashDir walks a directory before the files whose name extends it
+		{"nested storage", map[string]string{"ns": "1\n", "ns.list": "2\n", "storage/ns/key": "3\n", "storage/ns.old/key": "4\n", "storage/ns/sub/key": "5\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gens := t.TempDir()
+			dir := &dirStore{gens}
+			mem := newMemStore(gens)
+			testCommit(t, dir, gens, 1, tt.files)
+			testCommit(t, mem, gens, 1, tt.files)
+			if got, want := mem.Hash(1), dir.Hash(1); got != want {
+				t.Fatalf("memory store hash %s, directory store hash %s", got, want)
+			}
+			if leftovers := testLeftovers(t, gens); len(leftovers) > 0 {
+				t.Fatalf("temporary directories left: %v", leftovers)
+			}
+		})
+	}
+}
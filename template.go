@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// handler templates, declared in the top-level templates section and used with `extends: <template>`
+// a template may extend another one, every field set by the handler replaces the one of its template,
+// except setup, whose entries come before the template's as the first matching one is run, and params, merged parameter by parameter
+// ${param} is replaced with the value of the parameter in every field, once the templates are merged
+// templates are merged as raw yaml, so that a field set to false or "" still overrides the template
+
+type templateFields map[string]interface{}
+
+type templateConfig struct {
+	Templates map[string]templateFields `yaml:"templates"`
+	Handlers  []templateFields          `yaml:"handlers"`
+}
+
+// name of a handler for error messages, before it is decoded
+func templateHandlerName(fields templateFields, i int) string {
+	if name, ok := fields["name"].(string); ok && name != "" {
+		return name
+	}
+	if preset, ok := fields["preset"].(string); ok && preset != "" {
+		return preset
+	}
+	return "#" + strconv.Itoa(i + 1)
+}
+
+func templateMerge(base templateFields, fields templateFields) templateFields {
+	merged := make(templateFields)
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		switch k {
+		case "setup":
+			baseSetup, _ := base[k].([]interface{})
+			setup, _ := v.([]interface{})
+			merged[k] = append(slices.Clone(setup), baseSetup...)
+		case "params":
+			params := make(map[interface{}]interface{})
+			baseParams, _ := base[k].(map[interface{}]interface{})
+			for name, value := range baseParams {
+				params[name] = value
+			}
+			fieldParams, _ := v.(map[interface{}]interface{})
+			for name, value := range fieldParams {
+				params[name] = value
+			}
+			merged[k] = params
+		default:
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// chain holds the templates already extended, to detect cycles
+func templateResolve(templates map[string]templateFields, fields templateFields, owner string, chain []string) (templateFields, bool) {
+	name, _ := fields["extends"].(string)
+	if name == "" {
+		return fields, true
+	}
+	if slices.Contains(chain, name) {
+		logError("Templates extend each other in a cycle: " + strings.Join(append(chain, name), " -> "))
+		return nil, false
+	}
+	template, found := templates[name]
+	if ! found {
+		logError(owner + " extends unknown template '" + name + "'")
+		return nil, false
+	}
+	base, ok := templateResolve(templates, template, "Template " + name, append(chain, name))
+	if ! ok {
+		return nil, false
+	}
+	merged := templateMerge(base, fields)
+	merged["extends"] = name
+	return merged, true
+}
+
+func templateSubstitute(v interface{}, params map[string]string) interface{} {
+	switch v := v.(type) {
+	case string:
+		for name, value := range params {
+			v = strings.ReplaceAll(v, "${" + name + "}", value)
+		}
+		return v
+	case []interface{}:
+		var substituted []interface{}
+		for _, item := range v {
+			substituted = append(substituted, templateSubstitute(item, params))
+		}
+		return substituted
+	case map[interface{}]interface{}:
+		substituted := make(map[interface{}]interface{})
+		for k, item := range v {
+			substituted[k] = templateSubstitute(item, params)
+		}
+		return substituted
+	}
+	return v
+}
+
+// decodes the handlers of the configuration file again, with their templates applied
+func templateApply(data []byte, config *Config) bool {
+	var raw templateConfig
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		logError("Could not read the templates of " + configFileName + ": " + err.Error())
+		return false
+	}
+	// templates are checked even when no handler uses them
+	for name, template := range raw.Templates {
+		if _, ok := templateResolve(raw.Templates, template, "Template " + name, []string{name}); ! ok {
+			return false
+		}
+	}
+
+	var handlers []templateFields
+	for i, fields := range raw.Handlers {
+		merged, ok := templateResolve(raw.Templates, fields, "Handler " + templateHandlerName(fields, i), nil)
+		if ! ok {
+			return false
+		}
+		params := make(map[string]string)
+		rawParams, _ := merged["params"].(map[interface{}]interface{})
+		for name, value := range rawParams {
+			params[fmt.Sprint(name)] = fmt.Sprint(value)
+		}
+		for k, v := range merged {
+			if k != "params" {
+				merged[k] = templateSubstitute(v, params)
+			}
+		}
+		handlers = append(handlers, merged)
+	}
+
+	out, err := yaml.Marshal(handlers)
+	if err == nil {
+		config.Handlers = nil
+		err = yaml.Unmarshal(out, &config.Handlers)
+	}
+	if err != nil {
+		logError("Could not apply the templates of " + configFileName + ": " + err.Error())
+		return false
+	}
+	return true
+}